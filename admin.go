@@ -0,0 +1,104 @@
+package pagemanager
+
+import (
+	"embed"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed pm-admin
+var adminFS embed.FS
+
+// admin serves the browser-based editor at <site>/pm-admin/. It uses the
+// /pm-api/ endpoints and is only available if the Pagemanager is writeable.
+// Visitors who are not logged in are sent to <site>/pm-login.
+func (pm *Pagemanager) admin(w http.ResponseWriter, r *http.Request, tildePrefix, pathName string) {
+	if pm.wfs == nil {
+		pm.NotFound().ServeHTTP(w, r)
+		return
+	}
+	if !pm.authorize(r) {
+		if pm.db != nil && (r.Method == "GET" || r.Method == "HEAD") {
+			http.Redirect(w, r, loginURL(r, tildePrefix), http.StatusFound)
+			return
+		}
+		pm.Error(w, r, "", http.StatusUnauthorized)
+		return
+	}
+	if pathName == "pm-admin" {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusFound)
+		return
+	}
+	name := strings.TrimPrefix(pathName, "pm-admin/")
+	switch name {
+	case "":
+		name = "index.html"
+	case "login.html":
+		// The fallback login page is a template served by pm-login.
+		pm.NotFound().ServeHTTP(w, r)
+		return
+	}
+	file, err := adminFS.Open(path.Join("pm-admin", name))
+	if err != nil {
+		pm.NotFound().ServeHTTP(w, r)
+		return
+	}
+	defer file.Close()
+	fileinfo, err := file.Stat()
+	if err != nil || fileinfo.IsDir() {
+		pm.NotFound().ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, name, time.Time{}, file.(io.ReadSeeker))
+}
+
+// dirEntry is an entry of the /pm-api/dir listing.
+type dirEntry struct {
+	Name      string    `json:"name"`
+	Dir       bool      `json:"dir"`
+	Page      bool      `json:"page"` // Whether the directory is a page.
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// apiDir lists a directory of the site's pm-src. Reserved pm- files are
+// omitted.
+func (pm *Pagemanager) apiDir(r *http.Request, sitePrefix, name string) (any, error) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return nil, &apiError{status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: r.Method + " not allowed"}
+	}
+	entries, err := siteReadDir(pm.fs, sitePrefix, name)
+	if err != nil {
+		return nil, err
+	}
+	list := []dirEntry{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "pm-") || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		fileinfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		item := dirEntry{
+			Name:      entry.Name(),
+			Dir:       entry.IsDir(),
+			Size:      fileinfo.Size(),
+			UpdatedAt: fileinfo.ModTime(),
+		}
+		if entry.IsDir() {
+			dirs := siteCandidates(sitePrefix, path.Join(name, entry.Name()))
+			file, _, err := openFirst(pm.fs, pageCandidates(dirs, pm.defaultLang()))
+			if err == nil {
+				file.Close()
+				item.Page = true
+			}
+		}
+		list = append(list, item)
+	}
+	return map[string]any{"path": name, "entries": list}, nil
+}
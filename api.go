@@ -0,0 +1,334 @@
+package pagemanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// apiError is the body of every failed /pm-api/ response.
+//
+//	{"error": {"code": "invalid_template", "message": "...", "errors": [{"file": "pm-src/index.md", "line": 3, "message": "unexpected EOF"}]}}
+type apiError struct {
+	status  int
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Errors  []templateError `json:"errors,omitempty"`
+}
+
+// templateError is one error reported when parsing a template, located by
+// file and line where possible.
+type templateError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+var templateErrorRegexp = regexp.MustCompile(`(?:template: )?([^\s:]+):(\d+)(?::\d+)?: (.*)$`)
+
+// templateErrors splits the error returned by Pagemanager.Template into its
+// individual errors.
+func templateErrors(err error) []templateError {
+	var errs []templateError
+	for _, line := range strings.Split(err.Error(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		match := templateErrorRegexp.FindStringSubmatch(line)
+		if match == nil {
+			errs = append(errs, templateError{Message: line})
+			continue
+		}
+		n, _ := strconv.Atoi(match[2])
+		errs = append(errs, templateError{File: match[1], Line: n, Message: match[3]})
+	}
+	return errs
+}
+
+// api serves the JSON content-editing API of the request's site. Paths are
+// relative to the site's pm-src.
+//
+//	GET  /pm-api/session                  the logged in user and the CSRF token
+//	GET  /pm-api/dir?path=blog            list the files in a directory
+//	GET  /pm-api/blocks?path=blog         list the blocks of a page and their values
+//	POST /pm-api/blocks?path=blog         save {"blocks": {"name": "value"}}
+//	GET  /pm-api/file?path=blog/index.md  read {"path": "...", "content": "..."}
+//	POST /pm-api/file?path=blog/index.md  save {"content": "..."}
+//	GET  /pm-api/revisions?path=blog/index.md          list the revisions of a file
+//	GET  /pm-api/diff?path=blog/index.md&from=1&to=2   diff two revisions (to defaults to the latest)
+//	POST /pm-api/restore?path=blog/index.md            restore {"revision": 1}
+//
+// Pages are validated with Pagemanager.Template before they are saved. In
+// every mode, requests other than GET must send the CSRF token from
+// /pm-api/session in the X-CSRF-Token header.
+func (pm *Pagemanager) api(w http.ResponseWriter, r *http.Request, sitePrefix, endpoint string) {
+	if !pm.authorize(r) {
+		writeAPIError(w, &apiError{status: http.StatusUnauthorized, Code: "unauthorized", Message: "not logged in"})
+		return
+	}
+	if endpoint == "session" {
+		pm.apiSession(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && !pm.checkCSRF(r, r.Header.Get("X-CSRF-Token")) {
+		writeAPIError(w, &apiError{status: http.StatusForbidden, Code: "invalid_csrf_token", Message: "invalid CSRF token"})
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" && pm.wfs == nil {
+		writeAPIError(w, &apiError{status: http.StatusForbidden, Code: "read_only", Message: errNotWriteable.Error()})
+		return
+	}
+	pathName := strings.Trim(r.URL.Query().Get("path"), "/")
+	if pathName == "" {
+		pathName = "."
+	}
+	if !fs.ValidPath(pathName) {
+		writeAPIError(w, &apiError{status: http.StatusBadRequest, Code: "invalid_path", Message: fmt.Sprintf("invalid path %q", pathName)})
+		return
+	}
+	name := path.Join(sitePrefix, "pm-src", pathName)
+	var v any
+	var err error
+	switch endpoint {
+	case "blocks":
+		v, err = pm.apiBlocks(r, name)
+	case "file":
+		v, err = pm.apiFile(r, sitePrefix, path.Join("pm-src", pathName))
+	case "dir":
+		v, err = pm.apiDir(r, sitePrefix, path.Join("pm-src", pathName))
+	case "revisions", "diff", "restore":
+		v, err = pm.apiRevisions(r, endpoint, sitePrefix, path.Join("pm-src", pathName))
+	default:
+		err = &apiError{status: http.StatusNotFound, Code: "not_found", Message: "no such endpoint " + endpoint}
+	}
+	if err != nil {
+		var apiErr *apiError
+		switch {
+		case errors.As(err, &apiErr):
+		case errors.Is(err, fs.ErrNotExist):
+			apiErr = &apiError{status: http.StatusNotFound, Code: "not_found", Message: err.Error()}
+		case errors.Is(err, errNoSuchRevision):
+			apiErr = &apiError{status: http.StatusNotFound, Code: "not_found", Message: err.Error()}
+		case errors.Is(err, errQuotaExceeded):
+			apiErr = &apiError{status: http.StatusInsufficientStorage, Code: "quota_exceeded", Message: err.Error()}
+		default:
+			apiErr = pm.internalError(r, err)
+		}
+		writeAPIError(w, apiErr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+// decodeJSON decodes the JSON body of a request that changes something. The
+// body must be sent as application/json from the same origin: browsers let
+// any page send a cross-origin text/plain or form POST without asking, but
+// not a JSON one.
+func decodeJSON(r *http.Request, v any) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return &apiError{status: http.StatusUnsupportedMediaType, Code: "invalid_content_type", Message: "Content-Type must be application/json"}
+	}
+	if crossOrigin(r) {
+		return &apiError{status: http.StatusForbidden, Code: "cross_origin", Message: "cross-origin requests are not allowed"}
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return &apiError{status: http.StatusBadRequest, Code: "invalid_json", Message: err.Error()}
+	}
+	return nil
+}
+
+// crossOrigin reports whether the browser says that the request was made by
+// a page of another origin.
+func crossOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host != r.Host {
+			return true
+		}
+	}
+	return false
+}
+
+// internalError returns the apiError for an unexpected error. Like
+// InternalServerError, it only shows err in offline mode; online, err is
+// logged and the client gets a generic message.
+func (pm *Pagemanager) internalError(r *http.Request, err error) *apiError {
+	if pm.mode == "offline" {
+		return &apiError{status: http.StatusInternalServerError, Code: "internal_error", Message: err.Error()}
+	}
+	log.Printf("%s %s%s: %v", r.Method, r.Host, r.URL.RequestURI(), err)
+	return &apiError{status: http.StatusInternalServerError, Code: "internal_error", Message: "internal error"}
+}
+
+func writeAPIError(w http.ResponseWriter, apiErr *apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": apiErr})
+}
+
+func (pm *Pagemanager) apiBlocks(r *http.Request, name string) (any, error) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		var body struct {
+			Blocks map[string]string `json:"blocks"`
+		}
+		err := decodeJSON(r, &body)
+		if err != nil {
+			return nil, err
+		}
+		err = pm.SaveBlocks(name, body.Blocks)
+		if err != nil {
+			if errors.Is(err, errNoSuchBlock) {
+				return nil, &apiError{status: http.StatusUnprocessableEntity, Code: "invalid_block", Message: err.Error()}
+			}
+			return nil, err
+		}
+	default:
+		return nil, &apiError{status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: r.Method + " not allowed"}
+	}
+	blocks, err := pm.Blocks(name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"blocks": blocks}, nil
+}
+
+func (pm *Pagemanager) apiFile(r *http.Request, sitePrefix, name string) (any, error) {
+	switch path.Ext(name) {
+	case ".html", ".md", ".txt":
+	default:
+		return nil, &apiError{status: http.StatusBadRequest, Code: "invalid_path", Message: "only .html, .md and .txt files can be edited"}
+	}
+	for _, segment := range strings.Split(name, "/")[1:] {
+		if strings.HasPrefix(segment, "pm-") {
+			return nil, &apiError{status: http.StatusBadRequest, Code: "invalid_path", Message: fmt.Sprintf("%s is reserved", segment)}
+		}
+	}
+	names := siteCandidates(sitePrefix, name)
+	switch r.Method {
+	case "GET", "HEAD":
+		b, names, err := readFirst(pm.fs, names)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"path": name, "content": string(b), "file": names[len(names)-1]}, nil
+	case "POST":
+		var body struct {
+			Content string `json:"content"`
+		}
+		err := decodeJSON(r, &body)
+		if err != nil {
+			return nil, err
+		}
+		// Save over the file currently in effect, else to the site's own
+		// pm-src.
+		filename := names[len(names)-1]
+		for _, candidate := range names {
+			if _, err := fs.Stat(pm.fs, candidate); err == nil {
+				filename = candidate
+				break
+			}
+		}
+		if ext := path.Ext(name); ext == ".html" || ext == ".md" {
+			_, err = pm.Template(filename, strings.NewReader(body.Content))
+			if err != nil {
+				return nil, &apiError{
+					status:  http.StatusUnprocessableEntity,
+					Code:    "invalid_template",
+					Message: "the template has errors",
+					Errors:  templateErrors(err),
+				}
+			}
+		}
+		err = pm.writeFile(filename, []byte(body.Content))
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"path": name, "content": body.Content, "file": filename}, nil
+	}
+	return nil, &apiError{status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: r.Method + " not allowed"}
+}
+
+// writeFile writes a file through the WriteableFS, creating its directory if
+// needed. All writes made on behalf of users go through writeFile and
+// removeFile, which record a revision of every file they change.
+func (pm *Pagemanager) writeFile(name string, data []byte) error {
+	if pm.wfs == nil {
+		return errNotWriteable
+	}
+	pm.revisionMu.Lock()
+	defer pm.revisionMu.Unlock()
+	err := pm.wfs.MkdirAll(path.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	undo, err := pm.record(name, data, false)
+	if err != nil {
+		return err
+	}
+	err = pm.wfs.WriteFile(name, data, 0644)
+	if err != nil {
+		_ = undo()
+		return err
+	}
+	return nil
+}
+
+func (pm *Pagemanager) removeFile(name string) error {
+	if pm.wfs == nil {
+		return errNotWriteable
+	}
+	pm.revisionMu.Lock()
+	defer pm.revisionMu.Unlock()
+	var undos []func() error
+	undoAll := func() {
+		for _, undo := range undos {
+			_ = undo()
+		}
+	}
+	err := fs.WalkDir(pm.fs, name, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		undo, err := pm.record(name, nil, true)
+		if err != nil {
+			return err
+		}
+		undos = append(undos, undo)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		undoAll()
+		return err
+	}
+	err = pm.wfs.RemoveAll(name)
+	if err != nil {
+		undoAll()
+		return err
+	}
+	return nil
+}
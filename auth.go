@@ -0,0 +1,419 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users log in at <site>/pm-login with a username and password. The session
+// cookie holds a random token (signed with Config.SecretKey) whose hash is
+// looked up in pm_session. A user may only edit the sites they have a role
+// for in pm_site_user, so a user who owns the ~alice site cannot edit ~bob.
+//
+// Every request that changes something must carry a CSRF token derived from
+// the session: the X-CSRF-Token header for /pm-api/ or the csrf_token form
+// field for forms. GET /pm-api/session returns the token.
+const (
+	sessionCookie   = "pm_session"
+	csrfCookie      = "pm_csrf"
+	sessionDuration = 30 * 24 * time.Hour
+)
+
+var errInvalidLogin = errors.New("invalid username or password")
+
+// User is a row of pm_user.
+type User struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username"`
+}
+
+// CreateUser adds a user with the given password to pm_user and returns
+// their user ID.
+func CreateUser(ctx context.Context, db *sql.DB, username, password string) (string, error) {
+	if username == "" || strings.ContainsAny(username, " \t\r\n/") {
+		return "", fmt.Errorf("invalid username %q", username)
+	}
+	if len(password) < 8 {
+		return "", fmt.Errorf("password must be at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	userID, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO pm_user (user_id, username, password_hash, created_at) VALUES (?, ?, ?, ?)",
+		userID, username, string(hash), sqlTime(time.Now()),
+	)
+	if err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+// GrantRole gives a user a role ("owner" or "editor") on a site, replacing
+// any role they had before.
+func GrantRole(ctx context.Context, db *sql.DB, siteID, userID, role string) error {
+	switch role {
+	case "owner", "editor":
+	default:
+		return fmt.Errorf("invalid role %q", role)
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO pm_site_user (site_id, user_id, role) VALUES (?, ?, ?)"+
+		" ON CONFLICT (site_id, user_id) DO UPDATE SET role = EXCLUDED.role",
+		siteID, userID, role,
+	)
+	return err
+}
+
+// SiteID returns the ID of the site in pm_site. It returns an error wrapping
+// fs.ErrNotExist if there is no such site.
+func SiteID(ctx context.Context, db *sql.DB, domain, subdomain, tildePrefix string) (string, error) {
+	var siteID string
+	err := db.QueryRowContext(ctx, "SELECT site_id FROM pm_site"+
+		" WHERE COALESCE(domain, '') = ? AND COALESCE(subdomain, '') = ? AND COALESCE(tilde_prefix, '') = ?",
+		domain, subdomain, tildePrefix,
+	).Scan(&siteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("site %q: %w", path.Join(domain, subdomain, tildePrefix), fs.ErrNotExist)
+	}
+	return siteID, err
+}
+
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// sign returns value followed by its signature.
+func (pm *Pagemanager) sign(value string) string {
+	mac := hmac.New(sha256.New, pm.secretKey)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the value of a signed string if its signature is valid.
+func (pm *Pagemanager) verify(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+	if !hmac.Equal([]byte(pm.sign(value)), []byte(signed)) {
+		return "", false
+	}
+	return value, true
+}
+
+func randomToken() (string, error) {
+	var b [32]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionToken returns the session token in the request's cookie, if it is
+// validly signed.
+func (pm *Pagemanager) sessionToken(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	token, ok := pm.verify(cookie.Value)
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// user returns the logged in user, or nil if there is none.
+func (pm *Pagemanager) user(r *http.Request) (*User, error) {
+	token := pm.sessionToken(r)
+	if token == "" || pm.db == nil {
+		return nil, nil
+	}
+	user := &User{}
+	err := pm.db.QueryRowContext(r.Context(), "SELECT pm_user.user_id, pm_user.username"+
+		" FROM pm_session JOIN pm_user ON pm_user.user_id = pm_session.user_id"+
+		" WHERE pm_session.session_hash = ? AND pm_session.expires_at > ?",
+		hashToken(token), sqlTime(time.Now()),
+	).Scan(&user.UserID, &user.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// role returns the user's role on the site, or "" if they have none.
+func (pm *Pagemanager) role(ctx context.Context, userID, domain, subdomain, tildePrefix string) (string, error) {
+	var role string
+	err := pm.db.QueryRowContext(ctx, "SELECT pm_site_user.role"+
+		" FROM pm_site_user JOIN pm_site ON pm_site.site_id = pm_site_user.site_id"+
+		" WHERE pm_site_user.user_id = ?"+
+		" AND COALESCE(pm_site.domain, '') = ? AND COALESCE(pm_site.subdomain, '') = ? AND COALESCE(pm_site.tilde_prefix, '') = ?",
+		userID, domain, subdomain, tildePrefix,
+	).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return role, err
+}
+
+// authorize reports whether the request may edit the request's site: always
+// for the writer on their own machine (offline mode), otherwise only for a
+// logged in user with a role on the site.
+func (pm *Pagemanager) authorize(r *http.Request) bool {
+	if pm.mode == "offline" {
+		return true
+	}
+	user, err := pm.user(r)
+	if err != nil || user == nil {
+		return false
+	}
+	domain, subdomain := splitHost(r.Host)
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	role, err := pm.role(r.Context(), user.UserID, domain, subdomain, tildePrefix)
+	if err != nil {
+		return false
+	}
+	return role == "owner" || role == "editor"
+}
+
+// csrfToken returns the CSRF token for the request's site. It is derived
+// from the session, or for visitors who are not logged in (e.g. on the login
+// page) from a random pm_csrf cookie which is set if needed. Each site gets a
+// different token, so that the token of one tilde site is useless on another.
+func (pm *Pagemanager) csrfToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	base := pm.sessionToken(r)
+	if base == "" {
+		if cookie, err := r.Cookie(csrfCookie); err == nil {
+			base, _ = pm.verify(cookie.Value)
+		}
+	}
+	if base == "" {
+		if w == nil {
+			return "", nil
+		}
+		token, err := randomToken()
+		if err != nil {
+			return "", err
+		}
+		base = token
+		http.SetCookie(w, &http.Cookie{
+			Name:     csrfCookie,
+			Value:    pm.sign(base),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	domain, subdomain := splitHost(r.Host)
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	mac := hmac.New(sha256.New, pm.secretKey)
+	mac.Write([]byte("csrf\x00" + path.Join(domain, subdomain, tildePrefix) + "\x00" + base))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkCSRF reports whether token is the CSRF token of the request.
+func (pm *Pagemanager) checkCSRF(r *http.Request, token string) bool {
+	want, err := pm.csrfToken(nil, r)
+	if err != nil || want == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(token)) == 1
+}
+
+// login serves the login page of the site. The page is rendered from
+// pm-template/pm-login.html (so that it can use the site's theme), falling
+// back to a built-in page. The template is given .CSRFToken, .Next, .Username
+// and .Error.
+func (pm *Pagemanager) login(w http.ResponseWriter, r *http.Request, sitePrefix string) {
+	if pm.db == nil {
+		pm.NotFound().ServeHTTP(w, r)
+		return
+	}
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	next := r.FormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = path.Join("/", tildePrefix, "pm-admin") + "/"
+	}
+	data := map[string]any{
+		"URL":      r.URL,
+		"Next":     next,
+		"Username": r.FormValue("username"),
+	}
+	statusCode := http.StatusOK
+	switch r.Method {
+	case "GET", "HEAD":
+	case "POST":
+		if !pm.checkCSRF(r, r.FormValue("csrf_token")) {
+			pm.Error(w, r, "invalid CSRF token, go back and try again", http.StatusForbidden)
+			return
+		}
+		token, err := pm.createSession(r.Context(), r.FormValue("username"), r.FormValue("password"))
+		if err == nil {
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    pm.sign(token),
+				Path:     "/",
+				Expires:  time.Now().Add(sessionDuration),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		if !errors.Is(err, errInvalidLogin) {
+			pm.InternalServerError(err).ServeHTTP(w, r)
+			return
+		}
+		data["Error"] = err.Error()
+		statusCode = http.StatusUnauthorized
+	default:
+		pm.Error(w, r, r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	csrfToken, err := pm.csrfToken(w, r)
+	if err != nil {
+		pm.InternalServerError(err).ServeHTTP(w, r)
+		return
+	}
+	data["CSRFToken"] = csrfToken
+	pm.pageContext(r, data)
+
+	var tmpl *template.Template
+	name := "pm-template/pm-login.html"
+	b, names, err := readFirst(pm.fs, siteCandidates(sitePrefix, name))
+	switch {
+	case err == nil:
+		name = names[len(names)-1]
+		tmpl, err = pm.Template(name, bytes.NewReader(b))
+	case errors.Is(err, fs.ErrNotExist):
+		name = "login.html"
+		tmpl, err = template.New(name).Funcs(pm.FuncMap()).ParseFS(adminFS, "pm-admin/login.html")
+	}
+	if err != nil {
+		pm.InternalServerError(err).ServeHTTP(w, r)
+		return
+	}
+	buf := bufpool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufpool.Put(buf)
+	err = tmpl.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		pm.InternalServerError(err).ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	_, _ = buf.WriteTo(w)
+}
+
+// createSession checks the user's password and returns a new session token.
+func (pm *Pagemanager) createSession(ctx context.Context, username, password string) (string, error) {
+	var userID, passwordHash string
+	err := pm.db.QueryRowContext(ctx, "SELECT user_id, password_hash FROM pm_user WHERE username = ?", username).Scan(&userID, &passwordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Compare against a dummy hash anyway so that the response time
+		// does not reveal whether the user exists.
+		_ = bcrypt.CompareHashAndPassword([]byte("$2a$10$7EqJtq98hPqEX7fNZaFWoOhi5BWX4Z3XTHFSvf0t.ZSzEpa0pzFFm"), []byte(password))
+		return "", errInvalidLogin
+	}
+	if err != nil {
+		return "", err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+	if err != nil {
+		return "", errInvalidLogin
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = pm.db.ExecContext(ctx, "INSERT INTO pm_session (session_hash, user_id, expires_at) VALUES (?, ?, ?)",
+		hashToken(token), userID, sqlTime(time.Now().Add(sessionDuration)),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// logout ends the session and redirects to the site's home page.
+func (pm *Pagemanager) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		pm.Error(w, r, r.Method+" not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !pm.checkCSRF(r, r.FormValue("csrf_token")) {
+		pm.Error(w, r, "invalid CSRF token, go back and try again", http.StatusForbidden)
+		return
+	}
+	if token := pm.sessionToken(r); token != "" && pm.db != nil {
+		_, err := pm.db.ExecContext(r.Context(), "DELETE FROM pm_session WHERE session_hash = ?", hashToken(token))
+		if err != nil {
+			pm.InternalServerError(err).ServeHTTP(w, r)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	http.Redirect(w, r, path.Join("/", tildePrefix)+"/", http.StatusFound)
+}
+
+// loginURL returns the URL of the login page that returns to the request's
+// URL after logging in.
+func loginURL(r *http.Request, tildePrefix string) string {
+	return path.Join("/", tildePrefix, "pm-login") + "?next=" + url.QueryEscape(r.URL.RequestURI())
+}
+
+// apiSession serves GET /pm-api/session.
+func (pm *Pagemanager) apiSession(w http.ResponseWriter, r *http.Request) {
+	user, err := pm.user(r)
+	if err != nil {
+		writeAPIError(w, pm.internalError(r, err))
+		return
+	}
+	csrfToken, err := pm.csrfToken(w, r)
+	if err != nil {
+		writeAPIError(w, pm.internalError(r, err))
+		return
+	}
+	v := map[string]any{"csrfToken": csrfToken, "user": user}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(v)
+}
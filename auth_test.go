@@ -0,0 +1,126 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB returns a migrated database in a temporary directory.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "pagemanager.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = Migrate(context.Background(), db, os.DirFS("sqlite_migrations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newTestSites returns an online Pagemanager with the tilde sites ~alice and
+// ~bob, owned by the users alice and bob, and the session cookie of alice.
+func newTestSites(t *testing.T) (*Pagemanager, *http.Cookie) {
+	t.Helper()
+	ctx := context.Background()
+	db := newTestDB(t)
+	pm, err := New(&Config{Mode: "online", FS: DirFS(t.TempDir()), DB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		userID, err := CreateUser(ctx, db, username, "password-"+username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pm.CreateSite(ctx, "", "", "~"+username, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pm.writeFile("~"+username+"/pm-src/index.html", []byte(username))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := pm.createSession(ctx, "alice", "password-alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pm, &http.Cookie{Name: sessionCookie, Value: pm.sign(token)}
+}
+
+func serve(pm *Pagemanager, r *http.Request) *httptest.ResponseRecorder {
+	r.Host = "localhost"
+	w := httptest.NewRecorder()
+	pm.Pagemanager(pm.NotFound()).ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIOtherSite(t *testing.T) {
+	pm, cookie := newTestSites(t)
+	r := httptest.NewRequest("GET", "/~alice/pm-api/file?path=index.html", nil)
+	r.AddCookie(cookie)
+	if w := serve(pm, r); w.Code != http.StatusOK {
+		t.Errorf("GET own site: got %d, want %d", w.Code, http.StatusOK)
+	}
+	r = httptest.NewRequest("GET", "/~bob/pm-api/file?path=index.html", nil)
+	r.AddCookie(cookie)
+	if w := serve(pm, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET other site: got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestAPICSRF(t *testing.T) {
+	pm, cookie := newTestSites(t)
+	csrfToken := func(sitePath string) string {
+		r := httptest.NewRequest("GET", sitePath+"pm-api/session", nil)
+		r.AddCookie(cookie)
+		w := serve(pm, r)
+		var body struct {
+			CSRFToken string `json:"csrfToken"`
+		}
+		err := json.NewDecoder(w.Body).Decode(&body)
+		if err != nil || body.CSRFToken == "" {
+			t.Fatalf("GET %spm-api/session: %d %v", sitePath, w.Code, err)
+		}
+		return body.CSRFToken
+	}
+	save := func(csrfToken string) int {
+		r := httptest.NewRequest("POST", "/~alice/pm-api/file?path=index.html", strings.NewReader(`{"content": "changed"}`))
+		r.Header.Set("Content-Type", "application/json")
+		if csrfToken != "" {
+			r.Header.Set("X-CSRF-Token", csrfToken)
+		}
+		r.AddCookie(cookie)
+		return serve(pm, r).Code
+	}
+	if code := save(""); code != http.StatusForbidden {
+		t.Errorf("POST without a CSRF token: got %d, want %d", code, http.StatusForbidden)
+	}
+	// alice has no role on the root site, so its token cannot come from
+	// its pm-api/session.
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Host = "localhost"
+	r.AddCookie(cookie)
+	rootToken, err := pm.csrfToken(nil, r)
+	if err != nil || rootToken == "" {
+		t.Fatalf("root site CSRF token: %q %v", rootToken, err)
+	}
+	if code := save(rootToken); code != http.StatusForbidden {
+		t.Errorf("POST with the CSRF token of another site: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := save(csrfToken("/~alice/")); code != http.StatusOK {
+		t.Errorf("POST with the site's CSRF token: got %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,240 @@
+package pagemanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Pages mark the regions that the site owner may edit with blocks:
+//
+//	<h1>{{ block "title" . }}Hello World{{ end }}</h1>
+//	{{ block "about-me" . }}
+//	I am a writer.
+//	{{ end }}
+//
+// Overrides are stored in pm-src/<route>/pm-blocks.json as a JSON object of
+// block name to value. A single line block is edited as plain text. A multi
+// line block is edited as markdown and rendered as HTML. Global ALL_CAPS
+// blocks and layout slots starting with ~ (such as ~content) are not
+// overridable per page.
+const blocksFile = "pm-blocks.json"
+
+// Block is an overridable block of a page.
+type Block struct {
+	Name       string `json:"name"`
+	Default    string `json:"default"`   // The body of the block in the template.
+	Multiline  bool   `json:"multiline"` // Whether the block is edited as markdown rather than a line of text.
+	Value      string `json:"value"`     // The override, if Overridden.
+	Overridden bool   `json:"overridden"`
+}
+
+var blockRegexp = regexp.MustCompile(`\{\{-?\s*block\s+("(?:[^"\\]|\\.)*"|` + "`[^`]*`" + `)`)
+
+// isBlockName reports whether a block can be overridden per page.
+func isBlockName(name string) bool {
+	return name != "" && !isGlobalName(name) && !strings.HasPrefix(name, "~") && path.Ext(name) == ""
+}
+
+func isMultiline(body string) bool {
+	return strings.Contains(strings.TrimSpace(body), "\n")
+}
+
+// Blocks returns the overridable blocks of the page name (as passed to
+// Handler) in the order they appear, with the page's overrides filled in.
+// Blocks are looked for in the page and the pm-template files it uses.
+func (pm *Pagemanager) Blocks(name string) ([]Block, error) {
+	handlerPath, sources, err := pm.pageSources(name)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []Block
+	seen := make(map[string]struct{})
+	for _, source := range sources {
+		b, err := fs.ReadFile(pm.fs, source)
+		if err != nil {
+			return nil, err
+		}
+		_, body, err := splitFrontMatter(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		t, err := template.New(source).Funcs(FuncMap()).Parse(body)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		for _, match := range blockRegexp.FindAllStringSubmatch(body, -1) {
+			blockName, err := strconv.Unquote(match[1])
+			if err != nil || !isBlockName(blockName) {
+				continue
+			}
+			if _, ok := seen[blockName]; ok {
+				continue
+			}
+			seen[blockName] = struct{}{}
+			block := Block{Name: blockName}
+			if t := t.Lookup(blockName); t != nil && t.Tree != nil {
+				block.Default = strings.TrimSpace(t.Tree.Root.String())
+			}
+			block.Multiline = isMultiline(block.Default)
+			blocks = append(blocks, block)
+		}
+	}
+	overrides, _, err := pm.blockOverrides(path.Dir(handlerPath))
+	if err != nil {
+		return nil, err
+	}
+	for i := range blocks {
+		if value, ok := overrides[blocks[i].Name]; ok {
+			blocks[i].Value = value
+			blocks[i].Overridden = true
+		}
+	}
+	return blocks, nil
+}
+
+// SaveBlocks replaces the block overrides of the page name with overrides.
+// Blocks not in overrides revert to their defaults. It fails if the
+// Pagemanager is not writeable or a block does not exist in the page.
+func (pm *Pagemanager) SaveBlocks(name string, overrides map[string]string) error {
+	if pm.wfs == nil {
+		return fmt.Errorf("save blocks: %w", errNotWriteable)
+	}
+	blocks, err := pm.Blocks(name)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]struct{})
+	for _, block := range blocks {
+		exists[block.Name] = struct{}{}
+	}
+	var unknown []string
+	for blockName := range overrides {
+		if _, ok := exists[blockName]; !ok {
+			unknown = append(unknown, strconv.Quote(blockName))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("save blocks: %w %s", errNoSuchBlock, strings.Join(unknown, ", "))
+	}
+	handlerPath, _, err := pm.pageSources(name)
+	if err != nil {
+		return err
+	}
+	// Write to the pm-blocks.json currently in effect, if there is one.
+	filename := path.Join(path.Dir(handlerPath), blocksFile)
+	_, names, err := pm.blockOverrides(path.Dir(handlerPath))
+	if err != nil {
+		return err
+	}
+	if _, err := fs.Stat(pm.fs, names[len(names)-1]); err == nil {
+		filename = names[len(names)-1]
+	}
+	if len(overrides) == 0 {
+		return pm.removeFile(filename)
+	}
+	b, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		return err
+	}
+	return pm.writeFile(filename, b)
+}
+
+var (
+	errNotWriteable = errors.New("filesystem is not writeable")
+	errNoSuchBlock  = errors.New("no such block")
+)
+
+// pageSources returns the file that the page name is rendered from and the
+// files that may contain its blocks: the page itself and the pm-template
+// files it uses.
+func (pm *Pagemanager) pageSources(name string) (handlerPath string, sources []string, err error) {
+	dirs := []string{name}
+	sitePrefix, rest, ok := splitSitePrefix(name)
+	if ok {
+		dirs = siteCandidates(sitePrefix, rest)
+	}
+	file, names, err := openFirst(pm.fs, pageCandidates(dirs, pm.defaultLang()))
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	handlerPath = names[len(names)-1]
+	if path.Base(handlerPath) == "handler.txt" {
+		return handlerPath, nil, nil
+	}
+	page, err := pm.template(handlerPath, pm.defaultLang(), file)
+	if err != nil {
+		return "", nil, err
+	}
+	sources = append(sources, handlerPath)
+	for _, dep := range page.deps {
+		if !strings.HasPrefix(dep, "pm-template/") && !strings.Contains(dep, "/pm-template/") {
+			continue
+		}
+		if ext := path.Ext(dep); ext != ".html" && ext != ".md" {
+			continue
+		}
+		if isGlobalName(strings.TrimSuffix(path.Base(dep), path.Ext(dep))) {
+			continue
+		}
+		if _, err := fs.Stat(pm.fs, dep); err != nil {
+			continue
+		}
+		sources = append(sources, dep)
+	}
+	return handlerPath, sources, nil
+}
+
+// blockOverrides reads the pm-blocks.json in dir, returning the names that
+// were looked at.
+func (pm *Pagemanager) blockOverrides(dir string) (map[string]string, []string, error) {
+	overrides := make(map[string]string)
+	names := []string{path.Join(dir, blocksFile)}
+	if sitePrefix, rest, ok := splitSitePrefix(dir); ok {
+		names = siteCandidates(sitePrefix, path.Join(rest, blocksFile))
+	}
+	b, names, err := readFirst(pm.fs, names)
+	if errors.Is(err, fs.ErrNotExist) {
+		return overrides, names, nil
+	}
+	if err != nil {
+		return nil, names, err
+	}
+	err = json.Unmarshal(b, &overrides)
+	if err != nil {
+		return nil, names, fmt.Errorf("%s: %w", names[len(names)-1], err)
+	}
+	return overrides, names, nil
+}
+
+// blockTemplate returns the template that renders a block override. The
+// value is never executed as a template: it is escaped if it replaces a
+// single line block and converted from markdown if it replaces a multi line
+// block.
+func blockTemplate(name, value string, multiline bool) (*template.Template, error) {
+	var content string
+	if multiline {
+		var buf bytes.Buffer
+		err := markdownConverter.Convert([]byte(value), &buf)
+		if err != nil {
+			return nil, err
+		}
+		content = buf.String()
+	} else {
+		content = html.EscapeString(value)
+	}
+	// Delimiters that cannot occur in the content leave it as a single text
+	// node.
+	return template.New(name).Delims("\x00{{", "}}\x00").Parse(strings.ReplaceAll(content, "\x00", ""))
+}
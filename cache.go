@@ -0,0 +1,78 @@
+package pagemanager
+
+import (
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// pageCache holds compiled pages keyed by handler path. An entry is only
+// used while the page and every file it depends on are unchanged.
+type pageCache struct {
+	mu    sync.RWMutex
+	pages map[string]*cachedPage
+}
+
+type cachedPage struct {
+	page    *pageTemplate
+	modtime time.Time            // Of the page itself.
+	latest  time.Time            // Of the page and its dependencies, whichever is newest.
+	stamps  map[string]time.Time // Of every dependency, zero if it did not exist.
+	langs   []string             // The languages the page exists in.
+}
+
+// get returns the cached page at handlerPath, or nil if it is missing or out
+// of date.
+func (c *pageCache) get(fsys fs.FS, handlerPath string, modtime time.Time) *cachedPage {
+	c.mu.RLock()
+	cached := c.pages[handlerPath]
+	c.mu.RUnlock()
+	if cached == nil || !cached.modtime.Equal(modtime) {
+		return nil
+	}
+	for name, stamp := range cached.stamps {
+		fileinfo, err := fs.Stat(fsys, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && stamp.IsZero() {
+				continue
+			}
+			return nil
+		}
+		if !fileinfo.ModTime().Equal(stamp) {
+			return nil
+		}
+	}
+	return cached
+}
+
+// newCachedPage stamps the dependencies of page.
+func newCachedPage(fsys fs.FS, modtime time.Time, page *pageTemplate) *cachedPage {
+	cached := &cachedPage{
+		page:    page,
+		modtime: modtime,
+		latest:  modtime,
+		stamps:  make(map[string]time.Time),
+	}
+	for _, name := range page.deps {
+		fileinfo, err := fs.Stat(fsys, name)
+		if err != nil {
+			cached.stamps[name] = time.Time{}
+			continue
+		}
+		cached.stamps[name] = fileinfo.ModTime()
+		if fileinfo.ModTime().After(cached.latest) {
+			cached.latest = fileinfo.ModTime()
+		}
+	}
+	return cached
+}
+
+func (c *pageCache) put(handlerPath string, cached *cachedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pages == nil {
+		c.pages = make(map[string]*cachedPage)
+	}
+	c.pages[handlerPath] = cached
+}
@@ -0,0 +1,108 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dbHandler returns the handler for the pm_route row of the site and path,
+// rendered in lang.
+// It returns an error wrapping fs.ErrNotExist if there is no such site or
+// route, or if the route has neither a template nor a handler, so that the
+// request can fall back to the pm-src files.
+//
+// A route with a handler is served by the handler of that name in
+// Config.Handlers. Otherwise the route's template (a pm-template file such as
+// post.html) is rendered with the route's JSON data as if it were a page at
+// pm-src/<path>/index.html containing
+//
+//	{{ template "post.html" . }}
+func (pm *Pagemanager) dbHandler(ctx context.Context, domain, subdomain, tildePrefix, lang, pathName string) (http.Handler, error) {
+	var siteID string
+	err := pm.db.QueryRowContext(ctx, "SELECT site_id FROM pm_site"+
+		" WHERE COALESCE(domain, '') = ? AND COALESCE(subdomain, '') = ? AND COALESCE(tilde_prefix, '') = ?",
+		domain, subdomain, tildePrefix,
+	).Scan(&siteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tmplName, rawData, handlerName sql.NullString
+	err = pm.db.QueryRowContext(ctx, "SELECT template, data, handler FROM pm_route WHERE site_id = ? AND path = ?",
+		siteID, pathName,
+	).Scan(&tmplName, &rawData, &handlerName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if handlerName.String != "" {
+		handler := pm.handlers[handlerName.String]
+		if handler == nil {
+			return nil, fmt.Errorf("route %q: handler %q does not exist", pathName, handlerName.String)
+		}
+		return handler, nil
+	}
+	if tmplName.String == "" {
+		return nil, fs.ErrNotExist
+	}
+	data := make(map[string]any)
+	if rawData.String != "" {
+		err = json.Unmarshal([]byte(rawData.String), &data)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: data: %w", pathName, err)
+		}
+	}
+
+	sitePrefix := path.Join(domain, subdomain, tildePrefix)
+	handlerPath := path.Join(sitePrefix, "pm-src", pathName, "index.html")
+	// Routes have no modtime of their own, so the cache entry is keyed by
+	// everything that determines the compiled page instead.
+	key := "pm_route\x00" + handlerPath + "\x00" + lang + "\x00" + tmplName.String
+	var cached *cachedPage
+	if pm.mode == "online" {
+		cached = pm.cache.get(pm.fs, key, time.Time{})
+	}
+	if cached == nil {
+		v, err, _ := pm.compile.Do(key, func() (any, error) {
+			src := "{{ template " + strconv.Quote(tmplName.String) + " . }}"
+			page, err := pm.template(handlerPath, lang, strings.NewReader(src))
+			if err != nil {
+				return nil, fmt.Errorf("route %q: %w", pathName, err)
+			}
+			cached := newCachedPage(pm.fs, time.Time{}, page)
+			if pm.mode == "online" {
+				pm.cache.put(key, cached)
+			}
+			return cached, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		cached = v.(*cachedPage)
+	}
+	// The route's data can change without any file changing and pm_route
+	// records no update time, so the page is served without a modtime:
+	// there is no Last-Modified and conditional requests get the full page.
+	return &pageHandler{
+		pm:          pm,
+		page:        cached.page,
+		handlerPath: handlerPath,
+		data:        data,
+		livereload:  pm.mode == "offline",
+		lang:        lang,
+		langs:       pm.languages,
+	}, nil
+}
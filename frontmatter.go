@@ -0,0 +1,291 @@
+package pagemanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitFrontMatter splits a page into its front matter and the rest of the
+// page. Front matter is a block at the very start of the page which is either
+// YAML delimited by --- lines, TOML delimited by +++ lines or a JSON object.
+//
+//	---
+//	title: Hello World
+//	date: 2022-08-04
+//	tags: [go, web]
+//	draft: true
+//	---
+//
+// Only flat key/value front matter is supported: values may be strings,
+// numbers, booleans, dates or lists of those. The front matter is replaced by
+// blank lines in rest so that template errors still report the right line.
+func splitFrontMatter(body string) (matter map[string]any, rest string, err error) {
+	var delim string
+	switch {
+	case strings.HasPrefix(body, "---\n"), strings.HasPrefix(body, "---\r\n"):
+		delim = "---"
+	case strings.HasPrefix(body, "+++\n"), strings.HasPrefix(body, "+++\r\n"):
+		delim = "+++"
+	case strings.HasPrefix(body, "{") && !strings.HasPrefix(body, "{{"):
+		dec := json.NewDecoder(strings.NewReader(body))
+		dec.UseNumber()
+		err = dec.Decode(&matter)
+		if err != nil {
+			return nil, "", fmt.Errorf("front matter: %w", err)
+		}
+		n := int(dec.InputOffset())
+		return normalizeJSON(matter).(map[string]any), strings.Repeat("\n", strings.Count(body[:n], "\n")) + body[n:], nil
+	default:
+		return nil, body, nil
+	}
+	start := strings.Index(body, "\n") + 1
+	end := start
+	for {
+		i := strings.Index(body[end:], "\n")
+		line := body[end:]
+		if i >= 0 {
+			line = body[end : end+i]
+		}
+		if strings.TrimRight(line, "\r") == delim {
+			break
+		}
+		if i < 0 {
+			return nil, "", fmt.Errorf("front matter: missing closing %s", delim)
+		}
+		end += i + 1
+	}
+	n := end + len(delim)
+	if n < len(body) && body[n] == '\r' {
+		n++
+	}
+	if n < len(body) && body[n] == '\n' {
+		n++
+	}
+	if delim == "---" {
+		matter, err = parseYAMLFrontMatter(body[start:end])
+	} else {
+		matter, err = parseTOMLFrontMatter(body[start:end])
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return matter, strings.Repeat("\n", strings.Count(body[:n], "\n")) + body[n:], nil
+}
+
+func parseYAMLFrontMatter(s string) (map[string]any, error) {
+	matter := make(map[string]any)
+	var listKey string
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("front matter line %d: unexpected list item", i+2)
+			}
+			v, err := parseFrontMatterValue(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")), true)
+			if err != nil {
+				return nil, fmt.Errorf("front matter line %d: %w", i+2, err)
+			}
+			list, _ := matter[listKey].([]any)
+			matter[listKey] = append(list, v)
+			continue
+		}
+		if line != trimmed {
+			return nil, fmt.Errorf("front matter line %d: nested values are not supported", i+2)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d: expected key: value", i+2)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if value == "" {
+			listKey = key
+			matter[key] = []any{}
+			continue
+		}
+		listKey = ""
+		v, err := parseFrontMatterValue(value, true)
+		if err != nil {
+			return nil, fmt.Errorf("front matter line %d: %w", i+2, err)
+		}
+		matter[key] = v
+	}
+	return matter, nil
+}
+
+func parseTOMLFrontMatter(s string) (map[string]any, error) {
+	matter := make(map[string]any)
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("front matter line %d: tables are not supported", i+2)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("front matter line %d: expected key = value", i+2)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		v, err := parseFrontMatterValue(strings.TrimSpace(value), false)
+		if err != nil {
+			return nil, fmt.Errorf("front matter line %d: %w", i+2, err)
+		}
+		matter[key] = v
+	}
+	return matter, nil
+}
+
+// parseFrontMatterValue parses a scalar or an inline [list]. Unquoted strings
+// are only allowed in YAML.
+func parseFrontMatterValue(s string, yaml bool) (any, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated list %s", s)
+		}
+		list := []any{}
+		for _, item := range splitFrontMatterList(s[1 : len(s)-1]) {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			v, err := parseFrontMatterValue(item, yaml)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	}
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		if yaml {
+			return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+		}
+		return s[1 : len(s)-1], nil
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	}
+	if yaml {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = strings.TrimSpace(s[:i])
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int(n), nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	if t, ok := parseFrontMatterTime(s); ok {
+		return t, nil
+	}
+	if yaml {
+		return s, nil
+	}
+	return nil, fmt.Errorf("invalid value %s", s)
+}
+
+func parseFrontMatterTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// published reports whether a page with the front matter is live at now: it
+// is not a draft, its publishAt (if any) has passed and its expireAt (if any)
+// has not.
+func published(matter map[string]any, now time.Time) bool {
+	if draft, _ := matter["draft"].(bool); draft {
+		return false
+	}
+	if t, ok := frontMatterTime(matter["publishAt"]); ok && now.Before(t) {
+		return false
+	}
+	if t, ok := frontMatterTime(matter["expireAt"]); ok && !now.Before(t) {
+		return false
+	}
+	return true
+}
+
+func frontMatterTime(v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		return parseFrontMatterTime(v)
+	}
+	return time.Time{}, false
+}
+
+// splitFrontMatterList splits the items of an inline list on commas that are
+// not inside quotes.
+func splitFrontMatterList(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// normalizeJSON converts the json.Numbers in v into ints or floats, and
+// strings that look like dates into time.Time, to match YAML and TOML front
+// matter.
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			v[key] = normalizeJSON(value)
+		}
+		return v
+	case []any:
+		for i, value := range v {
+			v[i] = normalizeJSON(value)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return int(n)
+		}
+		f, _ := v.Float64()
+		return f
+	case string:
+		if t, ok := parseFrontMatterTime(v); ok {
+			return t
+		}
+		return v
+	}
+	return v
+}
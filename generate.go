@@ -0,0 +1,471 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GenerateResult reports what a call to Generate did. Paths are relative to
+// the output WriteableFS.
+type GenerateResult struct {
+	Rebuilt []string // Pages that were rendered.
+	Skipped []string // Pages whose sources were unchanged since the last run.
+	Removed []string // Outputs whose sources no longer exist.
+}
+
+// generateManifest is the file in the output directory that records which
+// source files every output was generated from.
+const generateManifest = "pm-generate.json"
+
+type fileStamp struct {
+	ModTime time.Time `json:"modTime"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"`
+}
+
+type generator struct {
+	pm      *Pagemanager
+	ctx     context.Context
+	out     WriteableFS
+	prev    map[string]map[string]fileStamp // output -> source -> stamp
+	next    map[string]map[string]fileStamp
+	seen    map[string]struct{}
+	now     time.Time // Pages are published or not as of now.
+	result  *GenerateResult
+	errmsgs []string
+}
+
+// Generate renders every page of every site into out, together with the
+// pm-static assets needed to serve them from a static host. If languages are
+// configured, every page is rendered once per language: the default language
+// at the site root and the others under /<lang>/. Error pages such as
+// pm-src/404.html are rendered at the root of their site. Only pages whose
+// source file or pm-template dependencies changed since the previous run are
+// rendered again, except pages that call query which are always rendered;
+// delete pm-generate.json from out to force a full rebuild.
+func (pm *Pagemanager) Generate(ctx context.Context, out WriteableFS) (*GenerateResult, error) {
+	g := &generator{
+		pm:     pm,
+		ctx:    ctx,
+		out:    out,
+		prev:   make(map[string]map[string]fileStamp),
+		next:   make(map[string]map[string]fileStamp),
+		seen:   make(map[string]struct{}),
+		now:    time.Now(),
+		result: &GenerateResult{},
+	}
+	b, err := fs.ReadFile(out, generateManifest)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		err = json.Unmarshal(b, &g.prev)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", generateManifest, err)
+		}
+	}
+	sites, err := sites(pm.fs)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sites {
+		err = g.generateSite(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for dest := range g.prev {
+		if _, ok := g.seen[dest]; ok {
+			continue
+		}
+		err = out.RemoveAll(dest)
+		if err != nil {
+			return nil, err
+		}
+		g.result.Removed = append(g.result.Removed, dest)
+	}
+	sort.Strings(g.result.Removed)
+	b, err = json.MarshalIndent(g.next, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = out.WriteFile(generateManifest, b, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if len(g.errmsgs) > 0 {
+		return g.result, fmt.Errorf("failed to generate %d page(s):\n%s", len(g.errmsgs), strings.Join(g.errmsgs, "\n"))
+	}
+	return g.result, nil
+}
+
+// generateSite writes the site's assets and pages into the output. Pages that
+// fail to render are recorded in g.errmsgs so that one broken page does not
+// stop the rest of the site from being generated.
+func (g *generator) generateSite(s site) error {
+	sitePrefix := s.prefix()
+	// Theme assets in pm-template (but not the templates themselves) are
+	// served from /pm-static/pm-template, same as Pagemanager.Static.
+	assets := make(map[string]struct{})
+	err := siteWalkDir(g.pm.fs, sitePrefix, "pm-template", func(name string, d fs.DirEntry) error {
+		if d.IsDir() {
+			return nil
+		}
+		if ext := path.Ext(name); ext == ".html" || ext == ".md" {
+			return nil
+		}
+		assets[path.Join("pm-static", name)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = siteWalkDir(g.pm.fs, sitePrefix, "pm-static", func(name string, d fs.DirEntry) error {
+		if !d.IsDir() {
+			assets[name] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name := range assets {
+		err = g.copy(path.Join(sitePrefix, name), staticCandidates(sitePrefix, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := siteReadDir(g.pm.fs, sitePrefix, "pm-src")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, entry := range entries {
+		if code, ok := errorCode(entry.Name()); ok && !entry.IsDir() {
+			err = g.errorPage(s, code)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	langs := g.pm.languages
+	if len(langs) == 0 {
+		langs = []string{""}
+	}
+	for _, lang := range langs {
+		// An unpublished page is skipped along with its files and the
+		// pages below it, which also removes their output if they were
+		// published before.
+		ok, err := g.pm.dirPublished(sitePrefix, lang, "pm-src", g.now)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = g.page(s, lang, "")
+		if err != nil {
+			return err
+		}
+		err = siteWalkDir(g.pm.fs, sitePrefix, "pm-src", func(name string, d fs.DirEntry) error {
+			select {
+			case <-g.ctx.Done():
+				return g.ctx.Err()
+			default:
+			}
+			if strings.HasPrefix(d.Name(), "pm-") {
+				if d.IsDir() {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			pathName := strings.TrimPrefix(name, "pm-src/")
+			if _, ok := errorCode(pathName); ok && !d.IsDir() {
+				return nil
+			}
+			if d.IsDir() {
+				ok, err := g.pm.dirPublished(sitePrefix, lang, name, g.now)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return fs.SkipDir
+				}
+				return g.page(s, lang, pathName)
+			}
+			if isPageFile(d.Name(), g.pm.languages) {
+				return nil
+			}
+			// Files with front matter are hidden like pages while they are
+			// unpublished, same as when they are served.
+			if ext := path.Ext(name); ext == ".md" || ext == ".html" {
+				file, names, err := openFirst(g.pm.fs, siteCandidates(sitePrefix, name))
+				if err != nil {
+					return err
+				}
+				file.Close()
+				ok, err := g.pm.filePublished(path.Join(sitePrefix, name), names[len(names)-1], lang, g.now)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return nil
+				}
+			}
+			return g.copy(path.Join(sitePrefix, g.langDir(lang), pathName), siteCandidates(sitePrefix, name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// langDir returns the directory that pages in lang are generated into,
+// relative to the site.
+func (g *generator) langDir(lang string) string {
+	if lang == g.pm.defaultLang() {
+		return ""
+	}
+	return lang
+}
+
+// page renders the site's page at pathName in lang, if there is one. Pages
+// served by a handler.txt are dynamic and are skipped.
+func (g *generator) page(s site, lang, pathName string) error {
+	filenames := []string{"index.html", "index.md"}
+	if lang != "" {
+		filenames = append([]string{"index." + lang + ".html", "index." + lang + ".md"}, filenames...)
+	}
+	var names []string
+	for _, dir := range siteCandidates(s.prefix(), path.Join("pm-src", pathName)) {
+		for _, filename := range filenames {
+			names = append(names, path.Join(dir, filename))
+		}
+	}
+	_, _, err := readFirst(g.pm.fs, names)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dest := path.Join(s.prefix(), g.langDir(lang), pathName, "index.html")
+	g.seen[dest] = struct{}{}
+	handler, err := g.pm.handler(path.Join(s.prefix(), "pm-src", pathName), lang, nil)
+	if err != nil {
+		g.errmsgs = append(g.errmsgs, err.Error())
+		return nil
+	}
+	page, ok := handler.(*pageHandler)
+	if !ok {
+		return nil
+	}
+	// A page that calls query (e.g. to list its subpages with Funcs.Index)
+	// may show anything, so it is always rendered again.
+	if !page.page.query && g.fresh(dest) {
+		g.result.Skipped = append(g.result.Skipped, dest)
+		return nil
+	}
+	page.livereload = false
+	r, err := http.NewRequestWithContext(g.ctx, "GET", "/"+path.Join(s.tildePrefix, g.langDir(lang), pathName), nil)
+	if err != nil {
+		return err
+	}
+	r.Host = s.host()
+	w := &responseRecorder{header: make(http.Header), code: http.StatusOK}
+	page.ServeHTTP(w, r)
+	if w.code != http.StatusOK {
+		g.errmsgs = append(g.errmsgs, fmt.Sprintf("%s: %d %s", page.handlerPath, w.code, http.StatusText(w.code)))
+		return nil
+	}
+	err = g.out.MkdirAll(path.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	err = g.out.WriteFile(dest, w.body.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	g.result.Rebuilt = append(g.result.Rebuilt, dest)
+	return g.record(dest, append([]string{page.handlerPath}, page.page.deps...))
+}
+
+// errorCode reports whether the site-relative path of a pm-src file is
+// that of an error page (e.g. 404.html), returning its status code.
+func errorCode(pathName string) (int, bool) {
+	code, err := strconv.Atoi(strings.TrimSuffix(pathName, ".html"))
+	if err != nil || !strings.HasSuffix(pathName, ".html") || code < 400 || http.StatusText(code) == "" {
+		return 0, false
+	}
+	return code, true
+}
+
+// errorPage renders the site's pm-src/<code>.html the way Pagemanager.Error
+// does, at <code>.html in the root of the site where static hosts look for
+// their error pages. Error pages are only rendered in the default language.
+func (g *generator) errorPage(s site, code int) error {
+	statusCode := strconv.Itoa(code)
+	dest := path.Join(s.prefix(), statusCode+".html")
+	g.seen[dest] = struct{}{}
+	if g.fresh(dest) {
+		g.result.Skipped = append(g.result.Skipped, dest)
+		return nil
+	}
+	b, names, err := readFirst(g.pm.fs, siteCandidates(s.prefix(), path.Join("pm-src", statusCode+".html")))
+	if err != nil {
+		return err
+	}
+	page, err := g.pm.template(names[len(names)-1], g.pm.defaultLang(), bytes.NewReader(b))
+	if err != nil {
+		g.errmsgs = append(g.errmsgs, err.Error())
+		return nil
+	}
+	r, err := http.NewRequestWithContext(g.ctx, "GET", "/"+path.Join(s.tildePrefix, statusCode+".html"), nil)
+	if err != nil {
+		return err
+	}
+	r.Host = s.host()
+	w := &responseRecorder{header: make(http.Header), code: http.StatusOK}
+	g.pm.Error(w, r, "", code)
+	err = g.out.MkdirAll(path.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	err = g.out.WriteFile(dest, w.body.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	g.result.Rebuilt = append(g.result.Rebuilt, dest)
+	return g.record(dest, append(names, page.deps...))
+}
+
+// fresh reports whether dest exists and none of the sources it was generated
+// from have changed. A source whose modtime changed is hashed before it is
+// considered changed, so that touching a file does not trigger a rebuild.
+// Sources recorded as missing must still be missing.
+func (g *generator) fresh(dest string) bool {
+	sources, ok := g.prev[dest]
+	if !ok {
+		return false
+	}
+	if _, err := fs.Stat(g.out, dest); err != nil {
+		return false
+	}
+	stamps := make(map[string]fileStamp)
+	for name, stamp := range sources {
+		fileinfo, err := fs.Stat(g.pm.fs, name)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && stamp.Hash == "" {
+				stamps[name] = stamp
+				continue
+			}
+			return false
+		}
+		if stamp.Hash == "" {
+			return false
+		}
+		if !fileinfo.ModTime().Equal(stamp.ModTime) || fileinfo.Size() != stamp.Size {
+			hash, err := hashFile(g.pm.fs, name)
+			if err != nil || hash != stamp.Hash {
+				return false
+			}
+			stamp.ModTime, stamp.Size = fileinfo.ModTime(), fileinfo.Size()
+		}
+		stamps[name] = stamp
+	}
+	g.next[dest] = stamps
+	return true
+}
+
+// record stamps the sources of dest. Sources that do not exist are recorded
+// with an empty hash.
+func (g *generator) record(dest string, sources []string) error {
+	stamps := make(map[string]fileStamp)
+	for _, name := range sources {
+		fileinfo, err := fs.Stat(g.pm.fs, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			stamps[name] = fileStamp{}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		hash, err := hashFile(g.pm.fs, name)
+		if err != nil {
+			return err
+		}
+		stamps[name] = fileStamp{ModTime: fileinfo.ModTime(), Size: fileinfo.Size(), Hash: hash}
+	}
+	g.next[dest] = stamps
+	return nil
+}
+
+// copy copies the first of names that exists to dest.
+func (g *generator) copy(dest string, names []string) error {
+	g.seen[dest] = struct{}{}
+	if g.fresh(dest) {
+		return nil
+	}
+	file, names, err := openFirst(g.pm.fs, names)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	buf := bufpool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufpool.Put(buf)
+	_, err = buf.ReadFrom(file)
+	if err != nil {
+		return err
+	}
+	err = g.out.MkdirAll(path.Dir(dest), 0755)
+	if err != nil {
+		return err
+	}
+	err = g.out.WriteFile(dest, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return g.record(dest, names)
+}
+
+func hashFile(fsys fs.FS, name string) (string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *responseRecorder) Header() http.Header { return w.header }
+
+func (w *responseRecorder) WriteHeader(code int) { w.code = code }
+
+func (w *responseRecorder) Write(b []byte) (int, error) { return w.body.Write(b) }
@@ -0,0 +1,73 @@
+package pagemanager
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// isGlobalName reports whether a template name is ALL_CAPS, e.g. SITE_NAME.
+func isGlobalName(name string) bool {
+	if name == "" || name[0] < 'A' || name[0] > 'Z' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// global returns the site-wide definition of the ALL_CAPS block name, read
+// from pm-template/<name>.txt, pm-template/<name>.md or
+// pm-template/<name>.html (shadowed by pm-site as a whole). Every page that
+// has the block shares the definition, so that text like the site name or
+// footer is edited in one place:
+//
+//	<title>{{ block "SITE_NAME" . }}My Site{{ end }}</title>
+//
+// .txt files are inserted as escaped text, .md files are converted to HTML
+// and .html files are templates. It returns a nil template if there is no
+// such file or the file is empty, in which case the block keeps its default.
+func (pm *Pagemanager) global(sitePrefix, name string) (*template.Template, []string, error) {
+	var names []string
+	for _, dir := range siteCandidates(sitePrefix, "pm-template") {
+		for _, ext := range []string{".txt", ".md", ".html"} {
+			names = append(names, path.Join(dir, name+ext))
+		}
+	}
+	b, names, err := readFirst(pm.fs, names)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, names, nil
+	}
+	if err != nil {
+		return nil, names, err
+	}
+	filename := names[len(names)-1]
+	body := strings.TrimRight(string(b), "\r\n")
+	if strings.TrimSpace(body) == "" {
+		return nil, names, nil
+	}
+	var t *template.Template
+	switch path.Ext(filename) {
+	case ".txt":
+		t, err = template.New(name).Funcs(FuncMap()).Parse("{{ " + strconv.Quote(body) + " }}")
+	case ".md":
+		t, err = template.New(name).Funcs(FuncMap()).Parse(body)
+		if err == nil {
+			t, err = Markdownify(t, FuncMap())
+		}
+	default:
+		t, err = template.New(name).Funcs(FuncMap()).Parse(body)
+	}
+	if err != nil {
+		return nil, names, fmt.Errorf("%s: %w", filename, err)
+	}
+	return t, names, nil
+}
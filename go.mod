@@ -3,8 +3,10 @@ module pagemanager
 go 1.18
 
 require (
+	github.com/mattn/go-sqlite3 v1.14.15
 	github.com/yuin/goldmark v1.4.13
 	github.com/yuin/goldmark-highlighting v0.0.0-20220208100518-594be1970594
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	golang.org/x/sync v0.0.0-20220722155255-886fb9371eb4
 )
 
@@ -0,0 +1,187 @@
+package pagemanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Translations live in pm-src/pm-i18n/<lang>.json (shadowed by pm-site like
+// any other pm-src file). A message is either a string or an object of plural
+// forms, and may interpolate the named arguments passed to t:
+//
+//	{
+//	    "greeting": "Hello, {name}!",
+//	    "comments": {"zero": "No comments", "one": "One comment", "other": "{count} comments"}
+//	}
+//
+//	{{ t "greeting" "name" .Name }}
+//	{{ t "comments" "count" (len .Comments) }}
+//
+// The plural form is picked by the count argument. Messages missing from a
+// language fall back to the default language and then to the key itself.
+const i18nDir = "pm-src/pm-i18n"
+
+// translator returns the t template function for lang together with the
+// catalog files it was loaded from.
+func (pm *Pagemanager) translator(sitePrefix, lang string) (func(string, ...any) (string, error), []string, error) {
+	langs := []string{lang}
+	if defaultLang := pm.defaultLang(); defaultLang != lang {
+		langs = append(langs, defaultLang)
+	}
+	var deps []string
+	var catalogs []map[string]any
+	for _, l := range langs {
+		if l == "" {
+			continue
+		}
+		b, names, err := readFirst(pm.fs, siteCandidates(sitePrefix, path.Join(i18nDir, l+".json")))
+		deps = append(deps, names...)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		catalog := make(map[string]any)
+		err = json.Unmarshal(b, &catalog)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", names[len(names)-1], err)
+		}
+		catalogs = append(catalogs, catalog)
+	}
+	t := func(key string, args ...any) (string, error) {
+		if len(args)%2 != 0 {
+			return "", fmt.Errorf("t %q: odd number of arguments", key)
+		}
+		var msg any = key
+		for _, catalog := range catalogs {
+			if v, ok := catalog[key]; ok {
+				msg = v
+				break
+			}
+		}
+		var count any
+		for i := 0; i < len(args); i += 2 {
+			if args[i] == "count" {
+				count = args[i+1]
+			}
+		}
+		var s string
+		switch msg := msg.(type) {
+		case string:
+			s = msg
+		case map[string]any:
+			s, _ = msg[pluralForm(msg, count)].(string)
+		default:
+			return "", fmt.Errorf("t %q: message is neither a string nor plural forms", key)
+		}
+		if len(args) == 0 {
+			return s, nil
+		}
+		oldnew := make([]string, 0, len(args))
+		for i := 0; i < len(args); i += 2 {
+			oldnew = append(oldnew, "{"+fmt.Sprint(args[i])+"}", fmt.Sprint(args[i+1]))
+		}
+		return strings.NewReplacer(oldnew...).Replace(s), nil
+	}
+	return t, deps, nil
+}
+
+// pluralForm returns the plural form of forms to use for count: zero or one if
+// the count matches and the form exists, else other.
+func pluralForm(forms map[string]any, count any) string {
+	n, ok := toFloat(count)
+	if !ok {
+		return "other"
+	}
+	if _, ok := forms["zero"]; ok && n == 0 {
+		return "zero"
+	}
+	if _, ok := forms["one"]; ok && n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+// readFirst reads the first of names that exists, returning the names that
+// were looked at.
+func readFirst(fsys fs.FS, names []string) ([]byte, []string, error) {
+	file, names, err := openFirst(fsys, names)
+	if err != nil {
+		return nil, names, err
+	}
+	defer file.Close()
+	buf := bufpool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufpool.Put(buf)
+	_, err = buf.ReadFrom(file)
+	if err != nil {
+		return nil, names, err
+	}
+	return append([]byte(nil), buf.Bytes()...), names, nil
+}
+
+// Alternate is a version of the current page in another language, for
+// <link rel="alternate" hreflang="..."> tags.
+type Alternate struct {
+	Lang string
+	URL  string
+}
+
+// alternates returns the languages that the page in dirs exists in. A page
+// with an index.html or index.md exists in every language, otherwise only in
+// the languages it has an index.<lang> file for. It also returns the files
+// that were looked at.
+func (pm *Pagemanager) alternates(dirs []string, handlerPath string) (langs, deps []string) {
+	switch path.Base(handlerPath) {
+	case "index.html", "index.md":
+		return pm.languages, nil
+	}
+	for _, lang := range pm.languages {
+		var names []string
+		for _, dir := range dirs {
+			names = append(names, path.Join(dir, "index."+lang+".html"), path.Join(dir, "index."+lang+".md"))
+		}
+		file, names, err := openFirst(pm.fs, names)
+		deps = append(deps, names...)
+		if err != nil {
+			continue
+		}
+		file.Close()
+		langs = append(langs, lang)
+	}
+	return langs, deps
+}
+
+// langURL returns the URL path of the page in lang. Pages in the default
+// language have no language code in their URL.
+func (pm *Pagemanager) langURL(tildePrefix, lang, pathName string) string {
+	if lang == pm.defaultLang() {
+		lang = ""
+	}
+	p := path.Join("/", tildePrefix, lang, pathName)
+	if p != "/" && strings.HasSuffix(pathName, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// isPageFile reports whether a file in pm-src is one of the files a page is
+// rendered from rather than a file served as is.
+func isPageFile(name string, languages []string) bool {
+	switch name {
+	case "index.html", "index.md", "handler.txt":
+		return true
+	}
+	for _, lang := range languages {
+		if name == "index."+lang+".html" || name == "index."+lang+".md" {
+			return true
+		}
+	}
+	return false
+}
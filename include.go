@@ -0,0 +1,200 @@
+package pagemanager
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template/parse"
+)
+
+// include returns the include template function for a page in the
+// site-relative directory dir (e.g. pm-src/blog), with t as the page's
+// translator. Relative names are resolved against dir
+// and absolute names against the site's pm-src, so pm-template files that
+// call include pull in content belonging to the page being rendered.
+//
+//	{{ include "changelog.md" }}
+//	{{ include "/blog/about-me/bio.txt" }}
+//	{{ include "card.md" .Card }}
+//
+// .md files are executed as templates (with the optional data argument as
+// dot) and converted to HTML, .txt files are inserted as escaped text. stack
+// holds the files that are currently being included and is used to report
+// include cycles.
+func (pm *Pagemanager) include(sitePrefix, dir string, t func(string, ...any) (string, error), stack []string) func(string, ...any) (any, error) {
+	return func(name string, data ...any) (any, error) {
+		if len(data) > 1 {
+			return nil, fmt.Errorf("include %q: too many arguments", name)
+		}
+		filename, err := includeName(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		for i, s := range stack {
+			if s == filename {
+				return nil, fmt.Errorf("include cycle: %s -> %s", strings.Join(stack[i:], " -> "), filename)
+			}
+		}
+		file, _, err := openFirst(pm.fs, siteCandidates(sitePrefix, filename))
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %w", name, err)
+		}
+		defer file.Close()
+		buf := bufpool.Get().(*bytes.Buffer)
+		buf.Reset()
+		defer bufpool.Put(buf)
+		_, err = buf.ReadFrom(file)
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %w", name, err)
+		}
+		if path.Ext(filename) == ".txt" {
+			return buf.String(), nil
+		}
+		funcs := pm.FuncMap()
+		funcs["include"] = pm.include(sitePrefix, path.Dir(filename), t, append(stack[:len(stack):len(stack)], filename))
+		funcs["t"] = t
+		tmpl, err := template.New(filename).Funcs(funcs).Parse(buf.String())
+		if err != nil {
+			return nil, err
+		}
+		if tmpl.Tree == nil {
+			return template.HTML(""), nil
+		}
+		buf.Reset()
+		err = markdownify(buf, tmpl.Tree.Root)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		tmpl, err = template.New(filename).Funcs(funcs).Parse(buf.String())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		var v any
+		if len(data) > 0 {
+			v = data[0]
+		}
+		buf.Reset()
+		err = tmpl.Execute(buf, v)
+		if err != nil {
+			return nil, err
+		}
+		return template.HTML(buf.String()), nil
+	}
+}
+
+// includeName resolves the name passed to include into a site-relative name.
+func includeName(dir, name string) (string, error) {
+	switch path.Ext(name) {
+	case ".md", ".txt":
+	default:
+		return "", fmt.Errorf("include %q: only .md and .txt files can be included", name)
+	}
+	var filename string
+	if strings.HasPrefix(name, "/") {
+		filename = path.Join("pm-src", name)
+	} else {
+		filename = path.Join(dir, name)
+	}
+	if !strings.HasPrefix(filename, "pm-src/") {
+		return "", fmt.Errorf("include %q: %w", name, fs.ErrInvalid)
+	}
+	return filename, nil
+}
+
+// includeDeps returns the files that may be opened by include calls with a
+// constant name in the templates, following .md files that include other
+// files. Includes with a computed name cannot be known ahead of time and are
+// not reported. It also reports whether the templates or the files they
+// include call query, whose results may depend on any file or on the DB.
+func (pm *Pagemanager) includeDeps(sitePrefix, dir string, tmpls []*template.Template) (deps []string, query bool) {
+	visited := make(map[string]struct{})
+	var walk func(dir string, node parse.Node)
+	walk = func(dir string, node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, n := range node.Nodes {
+				walk(dir, n)
+			}
+		case *parse.ActionNode:
+			walk(dir, node.Pipe)
+		case *parse.BranchNode:
+			walk(dir, node.Pipe)
+			walk(dir, node.List)
+			walk(dir, node.ElseList)
+		case *parse.IfNode:
+			walk(dir, &node.BranchNode)
+		case *parse.RangeNode:
+			walk(dir, &node.BranchNode)
+		case *parse.WithNode:
+			walk(dir, &node.BranchNode)
+		case *parse.TemplateNode:
+			walk(dir, node.Pipe)
+		case *parse.ChainNode:
+			walk(dir, node.Node)
+		case *parse.PipeNode:
+			if node == nil {
+				return
+			}
+			for _, cmd := range node.Cmds {
+				walk(dir, cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range node.Args {
+				walk(dir, arg)
+			}
+			ident, ok := node.Args[0].(*parse.IdentifierNode)
+			if ok && ident.Ident == "query" {
+				query = true
+			}
+			if !ok || ident.Ident != "include" || len(node.Args) < 2 {
+				return
+			}
+			str, ok := node.Args[1].(*parse.StringNode)
+			if !ok {
+				return
+			}
+			filename, err := includeName(dir, str.Text)
+			if err != nil {
+				return
+			}
+			if _, ok := visited[filename]; ok {
+				return
+			}
+			visited[filename] = struct{}{}
+			names := siteCandidates(sitePrefix, filename)
+			file, names, err := openFirst(pm.fs, names)
+			deps = append(deps, names...)
+			if err != nil {
+				return
+			}
+			defer file.Close()
+			if path.Ext(filename) != ".md" {
+				return
+			}
+			buf := bufpool.Get().(*bytes.Buffer)
+			buf.Reset()
+			defer bufpool.Put(buf)
+			_, err = buf.ReadFrom(file)
+			if err != nil {
+				return
+			}
+			t, err := template.New(filename).Funcs(FuncMap()).Parse(buf.String())
+			if err != nil || t.Tree == nil {
+				return
+			}
+			walk(path.Dir(filename), t.Tree.Root)
+		}
+	}
+	for _, t := range tmpls {
+		if t.Tree != nil {
+			walk(dir, t.Tree.Root)
+		}
+	}
+	return deps, query
+}
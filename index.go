@@ -0,0 +1,448 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// PageIndex is the result of Funcs.Index. Pages holds the current page of
+// entries while Total counts every entry that matched.
+type PageIndex struct {
+	url.URL
+	Pages       []IndexEntry
+	Total       int
+	CurrentPage int
+	PageCount   int
+	PrevURL     *url.URL // nil on the first page.
+	NextURL     *url.URL // nil on the last page.
+}
+
+type IndexEntry struct {
+	url.URL
+	Name      string // Directory or file name.
+	Ext       string // File extension, empty for directories.
+	Size      int64
+	UpdatedAt time.Time
+	Data      map[string]string
+	Page      map[string]any // Front matter.
+}
+
+type Funcs struct {
+	fs        fs.FS
+	db        *sql.DB
+	languages []string
+}
+
+// Index lists the pages under the current route. By default only
+// sub-directories with a page in the current language (an index.<lang>.html,
+// index.<lang>.md, index.html or index.md) are listed. Drafts and pages
+// outside their publishAt and expireAt times are never listed. It accepts the
+// following flags:
+//
+//	-files          also list the .md, .html and .txt files in the directory, so
+//	                that a directory of dated files can be a page without a
+//	                subroute per file
+//	-recursive      also list the pages in sub-directories
+//	-where key=val  only list entries whose field is val (repeatable). A list
+//	                field such as tags matches if it contains val
+//	-sort fields    comma separated fields to sort by, prefix a field with - to
+//	                sort it in descending order
+//	-reverse        reverse the order after sorting
+//	-limit n        list at most n entries per page
+//	-offset n       skip the first n entries
+//	-page n         which page of -limit entries to list, defaulting to the
+//	                page query parameter of the current URL
+//
+// Fields are name, ext, size, updatedAt and path, followed by the front
+// matter and data templates of each entry.
+//
+//	{{ query "github.com/pagemanager/pagemanager.Funcs.Index" .PageContext "-sort" "-updatedAt,name" "-limit" "10" }}
+func (f *Funcs) Index(pc *PageContext, args ...string) (any, error) {
+	var where []string
+	flagset := flag.NewFlagSet("Funcs.Index", flag.ContinueOnError)
+	flagset.SetOutput(io.Discard)
+	files := flagset.Bool("files", false, "")
+	recursive := flagset.Bool("recursive", false, "")
+	flagset.Func("where", "", func(s string) error {
+		if !strings.Contains(s, "=") {
+			return fmt.Errorf("%q is not of the form key=value", s)
+		}
+		where = append(where, s)
+		return nil
+	})
+	sortFields := flagset.String("sort", "", "")
+	reverse := flagset.Bool("reverse", false, "")
+	limit := flagset.Int("limit", 0, "")
+	offset := flagset.Int("offset", 0, "")
+	pageNumber := flagset.String("page", "", "")
+	err := flagset.Parse(args)
+	if err != nil {
+		return nil, fmt.Errorf("Funcs.Index: %w", err)
+	}
+	if *limit < 0 {
+		return nil, fmt.Errorf("Funcs.Index: invalid limit %d", *limit)
+	}
+	if *offset < 0 {
+		return nil, fmt.Errorf("Funcs.Index: invalid offset %d", *offset)
+	}
+	currentPage := 1
+	if *pageNumber != "" {
+		currentPage, err = strconv.Atoi(*pageNumber)
+		if err != nil || currentPage < 1 {
+			return nil, fmt.Errorf("Funcs.Index: invalid page %q", *pageNumber)
+		}
+	} else if n, err := strconv.Atoi(pc.URL.Query().Get("page")); err == nil && n > 0 {
+		// The page query parameter comes from the visitor, so an invalid
+		// value is ignored instead of failing the whole page.
+		currentPage = n
+	}
+
+	fsys := pc.FS
+	if fsys == nil {
+		fsys = siteFS{fsys: f.fs, sitePrefix: path.Join(pc.Domain, pc.Subdomain, pc.TildePrefix)}
+	}
+	ctx := pc.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	u := pc.URL
+	pages, err := f.index(ctx, fsys, u, pc.Path, pc.Lang, *files, *recursive)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, page := range pages {
+		if page.match(where) {
+			pages[n] = page
+			n++
+		}
+	}
+	pages = pages[:n]
+	if *sortFields != "" {
+		fields := strings.Split(*sortFields, ",")
+		sort.SliceStable(pages, func(i, j int) bool {
+			for _, field := range fields {
+				field = strings.TrimSpace(field)
+				desc := strings.HasPrefix(field, "-")
+				field = strings.TrimPrefix(field, "-")
+				c := compareField(pages[i].Field(field), pages[j].Field(field))
+				if c == 0 {
+					continue
+				}
+				return (c < 0) != desc
+			}
+			return false
+		})
+	}
+	if *reverse {
+		for i, j := 0, len(pages)-1; i < j; i, j = i+1, j-1 {
+			pages[i], pages[j] = pages[j], pages[i]
+		}
+	}
+
+	index := &PageIndex{
+		URL:         *u,
+		Total:       len(pages),
+		CurrentPage: 1,
+		PageCount:   1,
+	}
+	start := *offset
+	end := len(pages)
+	if *limit > 0 {
+		index.CurrentPage = currentPage
+		index.PageCount = (len(pages) - *offset + *limit - 1) / *limit
+		if index.PageCount < 1 {
+			index.PageCount = 1
+		}
+		// Large visitor-supplied pages must not overflow start or end.
+		if currentPage > index.PageCount {
+			start = len(pages)
+		} else {
+			start += (currentPage - 1) * *limit
+		}
+		if *limit < end-start {
+			end = start + *limit
+		}
+		if currentPage > 1 {
+			index.PrevURL = pageURL(u, currentPage-1)
+		}
+		if currentPage < index.PageCount {
+			index.NextURL = pageURL(u, currentPage+1)
+		}
+	}
+	if start > len(pages) {
+		start = len(pages)
+	}
+	if end > len(pages) {
+		end = len(pages)
+	}
+	index.Pages = pages[start:end]
+	return index, nil
+}
+
+// pageURL returns u with its page query parameter set to n.
+func pageURL(u *url.URL, n int) *url.URL {
+	v := *u
+	query := v.Query()
+	if n == 1 {
+		query.Del("page")
+	} else {
+		query.Set("page", strconv.Itoa(n))
+	}
+	v.RawQuery = query.Encode()
+	return &v
+}
+
+// index lists the entries of the directory pm-src/<pathName> in the site
+// filesystem fsys, reading pages in lang. u is the URL of the directory.
+func (f *Funcs) index(ctx context.Context, fsys fs.FS, u *url.URL, pathName, lang string, files, recursive bool) ([]IndexEntry, error) {
+	entries, err := fs.ReadDir(fsys, path.Join("pm-src", pathName))
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]IndexEntry, len(entries))
+	subpages := make([][]IndexEntry, len(entries))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, entry := range entries {
+		i, entry := i, entry
+		g.Go(func() error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			name := entry.Name()
+			// The pages below an unpublished page are not listed either, so
+			// sub-directories are only listed once their page is known to
+			// be published.
+			listSubpages := func() error {
+				if !entry.IsDir() || !recursive {
+					return nil
+				}
+				v := *u
+				v.Path = path.Join(u.Path, name)
+				sub, err := f.index(ctx, fsys, &v, path.Join(pathName, name), lang, files, recursive)
+				if err != nil {
+					return err
+				}
+				subpages[i] = sub
+				return nil
+			}
+			var names []string
+			if entry.IsDir() {
+				dir := path.Join("pm-src", pathName, name)
+				names = []string{path.Join(dir, "index.html"), path.Join(dir, "index.md")}
+				if lang != "" {
+					names = append([]string{path.Join(dir, "index."+lang+".html"), path.Join(dir, "index."+lang+".md")}, names...)
+				}
+			} else {
+				if !files || isPageFile(name, f.languages) {
+					return nil
+				}
+				switch path.Ext(name) {
+				case ".html", ".md", ".txt":
+				default:
+					return nil
+				}
+				names = []string{path.Join("pm-src", pathName, name)}
+			}
+			file, _, err := openFirst(fsys, names)
+			if errors.Is(err, fs.ErrNotExist) {
+				return listSubpages()
+			}
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			fileinfo, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			page := &pages[i]
+			page.URL = *u
+			page.URL.Path = path.Join(u.Path, name)
+			page.URL.RawQuery = ""
+			page.Name = name
+			if !entry.IsDir() {
+				page.Ext = path.Ext(name)
+			}
+			page.Size = fileinfo.Size()
+			page.UpdatedAt = fileinfo.ModTime()
+			page.Data = make(map[string]string)
+			filename := fileinfo.Name()
+			if path.Ext(filename) == ".txt" {
+				return nil
+			}
+			buf := bufpool.Get().(*bytes.Buffer)
+			buf.Reset()
+			defer bufpool.Put(buf)
+			_, err = buf.ReadFrom(file)
+			if err != nil {
+				return err
+			}
+			matter, body, err := splitFrontMatter(buf.String())
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			if !published(matter, time.Now()) {
+				page.Data = nil
+				return nil
+			}
+			t, err := template.New(filename).Funcs(FuncMap()).Parse(body)
+			if err != nil {
+				return err
+			}
+			if strings.HasSuffix(filename, ".md") {
+				t, err = Markdownify(t, FuncMap())
+				if err != nil {
+					return err
+				}
+			}
+			page.Page = matter
+			for _, t := range t.Templates() {
+				name := t.Name()
+				isDataTemplate := len(name) > 0 && unicode.IsUpper(rune(name[0]))
+				if t.Tree != nil && isDataTemplate && filepath.Ext(name) == "" {
+					page.Data[name] = t.Tree.Root.String()
+				}
+			}
+			return listSubpages()
+		})
+	}
+	err = g.Wait()
+	if err != nil {
+		return nil, err
+	}
+	var index []IndexEntry
+	for i, page := range pages {
+		if page.Data != nil {
+			index = append(index, page)
+		}
+		index = append(index, subpages[i]...)
+	}
+	return index, nil
+}
+
+// Field returns the value of the entry's field: one of name, ext, size,
+// updatedAt or path, else a front matter value or data template. It returns
+// nil if there is no such field.
+func (entry *IndexEntry) Field(name string) any {
+	switch name {
+	case "name":
+		return entry.Name
+	case "ext":
+		return entry.Ext
+	case "size":
+		return entry.Size
+	case "updatedAt":
+		return entry.UpdatedAt
+	case "path":
+		return entry.Path
+	}
+	if v, ok := entry.Page[name]; ok {
+		return v
+	}
+	if v, ok := entry.Data[name]; ok {
+		return v
+	}
+	return nil
+}
+
+func (entry *IndexEntry) match(where []string) bool {
+	for _, cond := range where {
+		key, value, _ := strings.Cut(cond, "=")
+		switch v := entry.Field(key).(type) {
+		case nil:
+			if value != "" {
+				return false
+			}
+		case []any:
+			found := false
+			for _, item := range v {
+				if fmt.Sprint(item) == value {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case time.Time:
+			if t, ok := parseFrontMatterTime(value); !ok || !t.Equal(v) {
+				return false
+			}
+		default:
+			if fmt.Sprint(v) != value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareField compares two field values, sorting missing values last.
+func compareField(a, b any) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		default:
+			return -1
+		}
+	}
+	switch a := a.(type) {
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1
+			case a.After(b):
+				return 1
+			}
+			return 0
+		}
+	case int, int64, float64:
+		x, _ := toFloat(a)
+		if y, ok := toFloat(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func toFloat(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,97 @@
+package pagemanager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+)
+
+// livereloadInterval is how often the site's files are checked for changes.
+// The filesystem is an fs.FS which may not be backed by the OS, so it is
+// polled instead of watched.
+const livereloadInterval = 500 * time.Millisecond
+
+// livereload streams a reload event to the browser over Server-Sent Events
+// whenever a file in the site's pm-src, pm-template or pm-static changes.
+func (pm *Pagemanager) livereload(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		pm.Error(w, r, "streaming unsupported", 500)
+		return
+	}
+	domain, subdomain := splitHost(r.Host)
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	sitePrefix := path.Join(domain, subdomain, tildePrefix)
+	signature, err := pm.signature(sitePrefix)
+	if err != nil {
+		pm.InternalServerError(err).ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(livereloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		next, err := pm.signature(sitePrefix)
+		if err != nil || next == signature {
+			continue
+		}
+		signature = next
+		_, err = fmt.Fprint(w, "data: reload\n\n")
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// signature hashes the name, size and modtime of every file that the site's
+// pages may be rendered from.
+func (pm *Pagemanager) signature(sitePrefix string) (uint64, error) {
+	h := fnv.New64a()
+	for _, dir := range []string{"pm-src", "pm-template", "pm-static"} {
+		for _, root := range siteCandidates(sitePrefix, dir) {
+			err := fs.WalkDir(pm.fs, root, func(name string, d fs.DirEntry, err error) error {
+				if err != nil {
+					if errors.Is(err, fs.ErrNotExist) {
+						return nil
+					}
+					return err
+				}
+				fileinfo, err := d.Info()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, "%s\x00%d\x00%d\x00", name, fileinfo.Size(), fileinfo.ModTime().UnixNano())
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return h.Sum64(), nil
+}
+
+// injectLivereload adds the script that listens for reload events to an HTML
+// page, just before </body> if there is one.
+func injectLivereload(b []byte, tildePrefix string) []byte {
+	script := `<script>new EventSource("` + path.Join("/", tildePrefix, "pm-livereload") + `").onmessage = function() { location.reload() }</script>`
+	i := bytes.LastIndex(bytes.ToLower(b), []byte("</body>"))
+	if i < 0 {
+		return append(b, script...)
+	}
+	return append(b[:i:i], append([]byte(script), b[i:]...)...)
+}
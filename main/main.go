@@ -1,21 +1,151 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"pagemanager"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func main() {
 	pm, err := pagemanager.New(&pagemanager.Config{
-		FS: os.DirFS("."),
+		Mode: "offline",
+		FS:   pagemanager.DirFS("."),
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	const addr = "127.0.0.1:8020"
-	fmt.Println("listening on " + addr)
-	fmt.Println(http.ListenAndServe(addr, pm.Pagemanager(pm.NotFound())))
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		flagset := flag.NewFlagSet("generate", flag.ExitOnError)
+		out := flagset.String("out", "pm-out", "output directory")
+		_ = flagset.Parse(os.Args[2:])
+		err = os.MkdirAll(*out, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+		result, err := pm.Generate(context.Background(), pagemanager.DirFS(*out))
+		if result != nil {
+			for _, name := range result.Rebuilt {
+				fmt.Println("rebuilt " + name)
+			}
+			for _, name := range result.Removed {
+				fmt.Println("removed " + name)
+			}
+			fmt.Printf("%d rebuilt, %d unchanged, %d removed\n", len(result.Rebuilt), len(result.Skipped), len(result.Removed))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		flagset := flag.NewFlagSet("migrate", flag.ExitOnError)
+		dsn := flagset.String("db", "pagemanager.db", "sqlite database file")
+		dir := flagset.String("dir", "sqlite_migrations", "migrations directory")
+		_ = flagset.Parse(os.Args[2:])
+		db, err := sql.Open("sqlite3", *dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		result, err := pagemanager.Migrate(context.Background(), db, os.DirFS(*dir))
+		if result != nil {
+			for _, name := range result.Applied {
+				fmt.Println("applied " + name)
+			}
+			fmt.Printf("%d applied\n", len(result.Applied))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "useradd" {
+		flagset := flag.NewFlagSet("useradd", flag.ExitOnError)
+		dsn := flagset.String("db", "pagemanager.db", "sqlite database file")
+		domain := flagset.String("domain", "", "domain of the site the user may edit")
+		subdomain := flagset.String("subdomain", "", "subdomain of the site the user may edit")
+		tildePrefix := flagset.String("tilde", "", "tilde prefix (e.g. ~alice) of the site the user may edit")
+		role := flagset.String("role", "owner", "owner | editor")
+		create := flagset.Bool("create", false, "create the tilde site from pm-starter and make the user its owner")
+		_ = flagset.Parse(os.Args[2:])
+		if flagset.NArg() != 1 {
+			log.Fatal("usage: useradd [flags] <username> (the password is read from $PM_PASSWORD or stdin)")
+		}
+		password := os.Getenv("PM_PASSWORD")
+		if password == "" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				log.Fatal(err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+		db, err := sql.Open("sqlite3", *dsn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
+		ctx := context.Background()
+		var siteID string
+		if !*create {
+			siteID, err = pagemanager.SiteID(ctx, db, *domain, *subdomain, *tildePrefix)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		userID, err := pagemanager.CreateUser(ctx, db, flagset.Arg(0), password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *create {
+			pm, err = pagemanager.New(&pagemanager.Config{FS: pagemanager.DirFS("."), DB: db})
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, err = pm.CreateSite(ctx, *domain, *subdomain, *tildePrefix, userID)
+		} else {
+			err = pagemanager.GrantRole(ctx, db, siteID, userID, *role)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("created user " + flagset.Arg(0))
+		return
+	}
+	flagset := flag.NewFlagSet("serve", flag.ExitOnError)
+	mode := flagset.String("mode", "offline", "offline | online")
+	dsn := flagset.String("db", "", "sqlite database file, required for logging in online")
+	addr := flagset.String("addr", "127.0.0.1:8020", "address to listen on")
+	quota := flagset.Int64("quota", 0, "maximum size in bytes of the tilde sites of each user, 0 for no limit")
+	_ = flagset.Parse(os.Args[1:])
+	if *mode != "offline" || *dsn != "" || *quota != 0 {
+		config := &pagemanager.Config{
+			Mode:      *mode,
+			FS:        pagemanager.DirFS("."),
+			SecretKey: []byte(os.Getenv("PM_SECRET_KEY")),
+			Quota:     *quota,
+		}
+		if *dsn != "" {
+			db, err := sql.Open("sqlite3", *dsn)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer db.Close()
+			config.DB = db
+		}
+		pm, err = pagemanager.New(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Println("listening on " + *addr)
+	fmt.Println(http.ListenAndServe(*addr, pm.Pagemanager(pm.NotFound())))
 }
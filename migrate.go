@@ -0,0 +1,296 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MigrateResult reports which files a call to Migrate applied.
+type MigrateResult struct {
+	Applied []string
+}
+
+// Migrate brings the database up to date with the migrations in fsys, a
+// directory laid out like sqlite_migrations:
+//
+//   - <version>_<name>.sql files in the top level directory are versioned
+//     migrations. They are applied once each in lexical order, so they should
+//     be named 001_schema.sql, 002_users.sql and so on. Changing a versioned
+//     migration after it has been applied is an error.
+//   - repeatable/*.sql files are applied after the versioned migrations and
+//     applied again whenever their contents change, which suits DROP/CREATE
+//     scripts for triggers and views.
+//   - <table>.csv files are loaded last, parents before children according to
+//     the table's foreign keys. The first line names the columns and \N stands
+//     for NULL. Rows that already exist are left alone, and a file is loaded
+//     again whenever its contents change so that new rows can be appended.
+//
+// Every file is applied in its own transaction together with its row in the
+// pm_migration table.
+func Migrate(ctx context.Context, db *sql.DB, fsys fs.FS) (*MigrateResult, error) {
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS pm_migration ("+
+		"filename TEXT PRIMARY KEY NOT NULL"+
+		", checksum TEXT NOT NULL"+
+		", applied_at DATETIME NOT NULL"+
+		")")
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string)
+	rows, err := db.QueryContext(ctx, "SELECT filename, checksum FROM pm_migration")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var filename, checksum string
+		err = rows.Scan(&filename, &checksum)
+		if err != nil {
+			return nil, err
+		}
+		checksums[filename] = checksum
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	result := &MigrateResult{}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	var seeds []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		switch path.Ext(name) {
+		case ".csv":
+			seeds = append(seeds, name)
+		case ".sql":
+			b, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				return nil, err
+			}
+			checksum := sqlChecksum(b)
+			if prev, ok := checksums[name]; ok {
+				if prev != checksum {
+					return nil, fmt.Errorf("%s has changed since it was applied", name)
+				}
+				continue
+			}
+			err = applyMigration(ctx, db, name, checksum, func(tx *sql.Tx) error {
+				_, err := tx.ExecContext(ctx, string(b))
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			result.Applied = append(result.Applied, name)
+		}
+	}
+
+	entries, err = fs.ReadDir(fsys, "repeatable")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := path.Join("repeatable", entry.Name())
+		if entry.IsDir() || path.Ext(name) != ".sql" {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		checksum := sqlChecksum(b)
+		if checksums[name] == checksum {
+			continue
+		}
+		err = applyMigration(ctx, db, name, checksum, func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, string(b))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Applied = append(result.Applied, name)
+	}
+
+	seeds, err = seedOrder(ctx, db, seeds)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range seeds {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		checksum := sqlChecksum(b)
+		if checksums[name] == checksum {
+			continue
+		}
+		table := strings.TrimSuffix(name, ".csv")
+		err = applyMigration(ctx, db, name, checksum, func(tx *sql.Tx) error {
+			return loadCSV(ctx, tx, table, string(b))
+		})
+		if err != nil {
+			return nil, err
+		}
+		result.Applied = append(result.Applied, name)
+	}
+	return result, nil
+}
+
+func sqlChecksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// applyMigration runs apply and records filename in pm_migration in the same
+// transaction.
+func applyMigration(ctx context.Context, db *sql.DB, filename, checksum string, apply func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = apply(tx)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO pm_migration (filename, checksum, applied_at) VALUES (?, ?, ?)"+
+		" ON CONFLICT (filename) DO UPDATE SET checksum = EXCLUDED.checksum, applied_at = EXCLUDED.applied_at",
+		filename, checksum, time.Now().UTC().Format("2006-01-02 15:04:05"),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return tx.Commit()
+}
+
+// seedOrder sorts the CSV files so that every table is loaded after the
+// tables its foreign keys refer to.
+func seedOrder(ctx context.Context, db *sql.DB, seeds []string) ([]string, error) {
+	sort.Strings(seeds)
+	present := make(map[string]struct{})
+	for _, name := range seeds {
+		present[name] = struct{}{}
+	}
+	parents := make(map[string][]string)
+	for _, name := range seeds {
+		table := strings.TrimSuffix(name, ".csv")
+		rows, err := db.QueryContext(ctx, "SELECT DISTINCT \"table\" FROM pragma_foreign_key_list(?)", table)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for rows.Next() {
+			var parent string
+			err = rows.Scan(&parent)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if parent != table {
+				parents[name] = append(parents[name], parent+".csv")
+			}
+		}
+		err = rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var order []string
+	state := make(map[string]int) // 1: visiting, 2: done
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("%s: foreign key cycle", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, parent := range parents[name] {
+			if _, ok := present[parent]; !ok {
+				continue
+			}
+			err := visit(parent)
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range seeds {
+		err := visit(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// loadCSV inserts the rows of a CSV file into table, skipping rows that
+// conflict with existing ones.
+func loadCSV(ctx context.Context, tx *sql.Tx, table, data string) error {
+	r := csv.NewReader(strings.NewReader(data))
+	columns, err := r.Read()
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(strings.TrimSpace(column))
+		params[i] = "?"
+	}
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO "+quoteIdentifier(table)+
+		" ("+strings.Join(quoted, ", ")+") VALUES ("+strings.Join(params, ", ")+")"+
+		" ON CONFLICT DO NOTHING")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	args := make([]any, len(columns))
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, value := range record {
+			if value == `\N` {
+				args[i] = nil
+			} else {
+				args[i] = value
+			}
+		}
+		_, err = stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
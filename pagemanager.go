@@ -3,6 +3,8 @@ package pagemanager
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,9 +12,11 @@ import (
 	"html/template"
 	"io"
 	"io/fs"
+	"log"
 	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
 	"strconv"
@@ -27,7 +31,7 @@ import (
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
 	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 var bufpool = sync.Pool{
@@ -42,29 +46,149 @@ type WriteableFS interface {
 	RemoveAll(name string) error
 }
 
+// DirFS returns a WriteableFS for the files in the directory dir.
+func DirFS(dir string) WriteableFS { return dirFS(dir) }
+
+type dirFS string
+
+func (dir dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(name)), nil
+}
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	return os.DirFS(string(dir)).Open(name)
+}
+
+func (dir dirFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(os.DirFS(string(dir)), name)
+}
+
+func (dir dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(os.DirFS(string(dir)), name)
+}
+
+func (dir dirFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	fullname, err := dir.join("writefile", name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fullname, data, perm)
+}
+
+func (dir dirFS) MkdirAll(name string, perm fs.FileMode) error {
+	fullname, err := dir.join("mkdirall", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(fullname, perm)
+}
+
+func (dir dirFS) RemoveAll(name string) error {
+	fullname, err := dir.join("removeall", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(fullname)
+}
+
+// Config configures a Pagemanager. Mode is one of:
+//
+//   - "offline": for a writer working on their own machine. pm-debug and live
+//     reload are enabled, error pages show the underlying error and FS may be
+//     written to if it is a WriteableFS. Pages are compiled on every request.
+//   - "online" (or ""): for serving a site to the public. pm-debug and live
+//     reload are disabled, internal errors are logged instead of shown and
+//     compiled pages are cached until their files change. FS is only written
+//     to if it is a WriteableFS and DB is set, by users logged in at
+//     <site>/pm-login who have a role on the site (see CreateUser and
+//     GrantRole).
 type Config struct {
 	Mode     string // "" | "offline" | "online"
 	FS       fs.FS
 	Handlers map[string]http.Handler
-	Queries  map[string]func(*url.URL, ...string) (any, error)
+	Queries  map[string]func(*PageContext, ...string) (any, error)
+
+	// Languages are the language codes that may start the path of a URL,
+	// e.g. /fr/blog or /~alice/fr/blog. The first one is the default language
+	// of pages whose URL has no language code.
+	Languages []string
+
+	// DB, if set, is consulted for a pm_route matching the request before
+	// falling back to pm-src. See sqlite_migrations for the schema.
+	DB *sql.DB
+
+	// SecretKey signs session cookies and CSRF tokens. If empty a random key
+	// is used, which logs everyone out whenever the program restarts.
+	SecretKey []byte
+
+	// Quota, if positive, limits the total size in bytes of the files of
+	// the tilde sites (see CreateSite) that each user owns. Without a DB it
+	// limits each tilde site instead.
+	Quota int64
 }
 
 type Pagemanager struct {
-	mode     string
-	fs       fs.FS
-	wfs      WriteableFS
-	handlers map[string]http.Handler
+	mode      string
+	fs        fs.FS
+	wfs       WriteableFS
+	handlers  map[string]http.Handler
+	queries   map[string]func(*PageContext, ...string) (any, error)
+	db        *sql.DB
+	secretKey []byte
+	languages []string
+	cache     pageCache
+	compile   singleflight.Group
+
+	revisionMu sync.Mutex
 }
 
 func New(c *Config) (*Pagemanager, error) {
+	mode := c.Mode
+	switch mode {
+	case "":
+		mode = "online"
+	case "offline", "online":
+	default:
+		return nil, fmt.Errorf("invalid mode %q", c.Mode)
+	}
 	pm := &Pagemanager{
-		mode:     c.Mode,
-		fs:       c.FS,
-		handlers: c.Handlers,
+		mode:      mode,
+		fs:        c.FS,
+		handlers:  c.Handlers,
+		db:        c.DB,
+		secretKey: c.SecretKey,
+		languages: c.Languages,
+		queries:   make(map[string]func(*PageContext, ...string) (any, error)),
+	}
+	// Queries are resolved per Pagemanager: the built-in queries first, then
+	// the ones registered with RegisterTemplateQuery, then Config.Queries.
+	funcs := &Funcs{fs: c.FS, db: c.DB, languages: c.Languages}
+	pm.queries["github.com/pagemanager/pagemanager.Funcs.Index"] = funcs.Index
+	pm.queries["github.com/pagemanager/pagemanager.Funcs.Sites"] = funcs.Sites
+	templateQueriesMu.RLock()
+	for name, query := range templateQueries {
+		pm.queries[name] = query
+	}
+	templateQueriesMu.RUnlock()
+	for name, query := range c.Queries {
+		pm.queries[name] = query
+	}
+	if pm.mode == "offline" || pm.db != nil {
+		pm.wfs, _ = c.FS.(WriteableFS)
+	}
+	if pm.wfs != nil && c.Quota > 0 {
+		pm.wfs = &quotaFS{WriteableFS: pm.wfs, db: c.DB, limit: c.Quota}
+	}
+	if len(pm.secretKey) == 0 {
+		pm.secretKey = make([]byte, 32)
+		_, err := rand.Read(pm.secretKey)
+		if err != nil {
+			return nil, err
+		}
 	}
-	// funcs := Funcs{fs: c.FS}
-	// pm.queries["github.com/pagemanager/pagemanager.Funcs.Index"] = funcs.Index
-	pm.wfs, _ = c.FS.(WriteableFS)
 	return pm, nil
 }
 
@@ -179,12 +303,62 @@ func markdownify(buf *bytes.Buffer, node parse.Node) error {
 	return nil
 }
 
+// PageContext describes the page being rendered to a template query. Pages
+// pass it to queries as .PageContext:
+//
+//	{{ query "github.com/pagemanager/pagemanager.Funcs.Index" .PageContext "-sort" "name" }}
+type PageContext struct {
+	Context     context.Context `json:"-"` // The request context.
+	URL         *url.URL
+	Domain      string
+	Subdomain   string
+	TildePrefix string
+	Path        string // The route, relative to the site root and without a leading slash.
+	Lang        string
+	// FS holds the files of the site. Names are relative to the site, e.g.
+	// pm-src/blog/index.md, and are resolved with the site's pm-site
+	// overrides. Only pm-src, pm-template and pm-static can be opened.
+	FS   fs.FS          `json:"-"`
+	Data map[string]any `json:"-"` // The current page's data.
+}
+
+func (pm *Pagemanager) pageContext(r *http.Request, data map[string]any) *PageContext {
+	domain, subdomain := splitHost(r.Host)
+	tildePrefix, lang, pathName := splitPath(r.URL.Path, pm.languages)
+	if lang == "" {
+		lang = pm.defaultLang()
+	}
+	pc := &PageContext{
+		Context:     r.Context(),
+		URL:         r.URL,
+		Domain:      domain,
+		Subdomain:   subdomain,
+		TildePrefix: tildePrefix,
+		Path:        pathName,
+		Lang:        lang,
+		FS:          siteFS{fsys: pm.fs, sitePrefix: path.Join(domain, subdomain, tildePrefix)},
+		Data:        data,
+	}
+	data["PageContext"] = pc
+	data["Lang"] = lang
+	return pc
+}
+
+// defaultLang returns the language of pages whose URL has no language code,
+// or "" if no languages are configured.
+func (pm *Pagemanager) defaultLang() string {
+	if len(pm.languages) == 0 {
+		return ""
+	}
+	return pm.languages[0]
+}
+
 var (
-	templateQueries   map[string]func(*url.URL, ...string) (any, error)
+	templateQueries   = make(map[string]func(*PageContext, ...string) (any, error))
 	templateQueriesMu sync.RWMutex
 )
 
-func RegisterTemplateQuery(name string, query func(*url.URL, ...string) (any, error)) {
+func RegisterTemplateQuery(name string, query func(*PageContext, ...string) (any, error)) {
 	templateQueriesMu.Lock()
 	defer templateQueriesMu.Unlock()
 	templateQueries[name] = query
@@ -200,7 +374,7 @@ var funcmap = map[string]any{
 		var key string
 		dict := make(map[string]any)
 		for i, arg := range args {
-			if i%2 != 0 {
+			if i%2 == 0 {
 				key, ok = arg.(string)
 				if !ok {
 					return nil, fmt.Errorf("argument %#v is not a string", arg)
@@ -237,6 +411,14 @@ var funcmap = map[string]any{
 		}
 		return buf.String(), nil
 	},
+	// include and t are bound to the page being rendered by
+	// Pagemanager.Template.
+	"include": func(name string, data ...any) (any, error) {
+		return nil, fmt.Errorf("include %q: not rendering a page", name)
+	},
+	"t": func(key string, args ...any) (string, error) {
+		return "", fmt.Errorf("t %q: not rendering a page", key)
+	},
 	"img": func(u *url.URL, src string, attrs ...string) (template.HTML, error) {
 		var b strings.Builder
 		b.WriteString("<img")
@@ -257,23 +439,38 @@ var funcmap = map[string]any{
 	},
 }
 
+// FuncMap returns the template functions, with query resolving against the
+// queries registered with RegisterTemplateQuery.
 func FuncMap() map[string]any {
-	m := make(map[string]any)
-	for name, fn := range funcmap {
-		m[name] = fn
-	}
-	queries := make(map[string]func(*url.URL, ...string) (any, error))
+	queries := make(map[string]func(*PageContext, ...string) (any, error))
 	templateQueriesMu.RLock()
 	defer templateQueriesMu.RUnlock()
 	for name, query := range templateQueries {
 		queries[name] = query
 	}
-	m["query"] = func(name string, p *url.URL, args ...string) (any, error) {
+	return funcMap(queries)
+}
+
+// FuncMap returns the template functions, with query resolving against the
+// Pagemanager's own queries.
+func (pm *Pagemanager) FuncMap() map[string]any {
+	return funcMap(pm.queries)
+}
+
+func funcMap(queries map[string]func(*PageContext, ...string) (any, error)) map[string]any {
+	m := make(map[string]any)
+	for name, fn := range funcmap {
+		m[name] = fn
+	}
+	m["query"] = func(name string, pc *PageContext, args ...string) (any, error) {
 		fn := queries[name]
 		if fn == nil {
 			return nil, fmt.Errorf("no such query %q", name)
 		}
-		return fn(p, args...)
+		if pc == nil {
+			return nil, fmt.Errorf("query %q: nil PageContext", name)
+		}
+		return fn(pc, args...)
 	}
 	m["hasQuery"] = func(name string) bool {
 		fn := queries[name]
@@ -282,110 +479,24 @@ func FuncMap() map[string]any {
 	return m
 }
 
-type PageIndex struct {
-	url.URL
-	Pages []IndexEntry
-}
-
-type IndexEntry struct {
-	url.URL
-	Data map[string]string
-}
-
-type Funcs struct{ fs fs.FS }
-
-func (f *Funcs) Index(u *url.URL, args ...string) (any, error) {
-	domain, subdomain := splitHost(u.Host)
-	tildePrefix, pathName := splitPath(u.Path)
-	entries, err := fs.ReadDir(f.fs, path.Join(domain, subdomain, tildePrefix, "pm-src", pathName))
-	if err != nil {
-		return nil, err
-	}
-	index := &PageIndex{
-		URL:   *u,
-		Pages: make([]IndexEntry, len(entries)),
-	}
-	g, ctx := errgroup.WithContext(context.Background())
-	for i, entry := range entries {
-		i, entry := i, entry
-		g.Go(func() error {
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			default:
-			}
-			if !entry.IsDir() {
-				return nil
-			}
-			dirname := entry.Name()
-			filenames := []string{"index.html", "index.md"}
-			var file fs.File
-			for _, filename := range filenames {
-				file, err = f.fs.Open(path.Join(domain, subdomain, tildePrefix, "pm-src", pathName, dirname, filename))
-				if errors.Is(err, fs.ErrNotExist) {
-					continue
-				}
-				break
-			}
-			if errors.Is(err, fs.ErrNotExist) {
-				return nil
-			}
-			if err != nil {
-				return err
-			}
-			fileinfo, err := file.Stat()
-			if err != nil {
-				return err
-			}
-			filename := fileinfo.Name()
-			defer file.Close()
-			buf := bufpool.Get().(*bytes.Buffer)
-			buf.Reset()
-			defer bufpool.Put(buf)
-			_, err = buf.ReadFrom(file)
-			if err != nil {
-				return err
-			}
-			body := buf.String()
-			t, err := template.New(filename).Funcs(FuncMap()).Parse(body)
-			if err != nil {
-				return err
-			}
-			if strings.HasSuffix(filename, ".md") {
-				t, err = Markdownify(t, FuncMap())
-				if err != nil {
-					return err
-				}
-			}
-			index.Pages[i].URL = *u
-			index.Pages[i].URL.Path = path.Join(u.Path, dirname)
-			index.Pages[i].Data = make(map[string]string)
-			for _, t := range t.Templates() {
-				name := t.Name()
-				isDataTemplate := len(name) > 0 && unicode.IsUpper(rune(name[0]))
-				if t.Tree != nil && isDataTemplate && filepath.Ext(name) == "" {
-					index.Pages[i].Data[name] = t.Tree.Root.String()
-				}
-			}
-			return nil
-		})
-	}
-	err = g.Wait()
+func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, error) {
+	page, err := pm.template(name, pm.defaultLang(), r)
 	if err != nil {
 		return nil, err
 	}
-	n := 0
-	for _, page := range index.Pages {
-		if page.Data != nil {
-			index.Pages[n] = page
-			n++
-		}
-	}
-	index.Pages = index.Pages[:n]
-	return index, nil
+	return page.tmpl, nil
 }
 
-func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, error) {
+// pageTemplate is a compiled page together with the pm-template files that
+// went into it.
+type pageTemplate struct {
+	tmpl   *template.Template
+	deps   []string
+	matter map[string]any
+	query  bool // The page calls query, so it depends on more than deps.
+}
+
+func (pm *Pagemanager) template(name, lang string, r io.Reader) (*pageTemplate, error) {
 	buf := bufpool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufpool.Put(buf)
@@ -393,7 +504,10 @@ func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, e
 	if err != nil {
 		return nil, err
 	}
-	body := buf.String()
+	matter, body, err := splitFrontMatter(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
 	main, err := template.New(name).Funcs(FuncMap()).Parse(body)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", name, err)
@@ -405,13 +519,16 @@ func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, e
 		}
 	}
 
+	sitePrefix, _, _ := splitSitePrefix(name)
 	visited := make(map[string]struct{})
-	page := template.New("").Funcs(FuncMap())
+	var deps []string
+	page := template.New("").Funcs(pm.FuncMap())
 	tmpls := main.Templates()
 	var tmpl *template.Template
 	var nodes []parse.Node
 	var node parse.Node
 	var errmsgs []string
+	var globals []*template.Template
 	for len(tmpls) > 0 {
 		tmpl, tmpls = tmpls[len(tmpls)-1], tmpls[:len(tmpls)-1]
 		if tmpl.Tree == nil {
@@ -441,6 +558,22 @@ func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, e
 					nodes = append(nodes, node.ElseList)
 				}
 			case *parse.TemplateNode:
+				if isGlobalName(node.Name) {
+					if _, ok := visited[node.Name]; ok {
+						continue
+					}
+					visited[node.Name] = struct{}{}
+					t, names, err := pm.global(sitePrefix, node.Name)
+					deps = append(deps, names...)
+					if err != nil {
+						return nil, err
+					}
+					if t != nil {
+						globals = append(globals, t)
+						tmpls = append(tmpls, t.Templates()...)
+					}
+					continue
+				}
 				if !strings.HasSuffix(node.Name, ".html") && !strings.HasSuffix(node.Name, ".md") {
 					continue
 				}
@@ -448,19 +581,22 @@ func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, e
 					continue
 				}
 				visited[node.Name] = struct{}{}
-				file, err := pm.fs.Open(path.Join("pm-template", node.Name))
+				file, names, err := openFirst(pm.fs, siteCandidates(sitePrefix, path.Join("pm-template", node.Name)))
+				deps = append(deps, names...)
 				if err != nil {
-					body := tmpl.Tree.Root.String()
-					pos := int(node.Position())
-					line := 1 + strings.Count(body[:pos], "\n")
+					// node.Position() is an offset into the original source
+					// which may have been rewritten by Markdownify, so let the
+					// tree work out the line and column instead.
+					location, _ := tmpl.Tree.ErrorContext(node)
 					if errors.Is(err, fs.ErrNotExist) {
-						errmsgs = append(errmsgs, fmt.Sprintf("%s line %d: %s does not exist", tmpl.Name(), line, node.String()))
+						errmsgs = append(errmsgs, fmt.Sprintf("%s: %s does not exist", location, node.String()))
 						continue
 					}
-					return nil, fmt.Errorf("%s line %d: %s: %w", tmpl.Name(), line, node.String(), err)
+					return nil, fmt.Errorf("%s: %s: %w", location, node.String(), err)
 				}
 				buf.Reset()
 				_, err = buf.ReadFrom(file)
+				file.Close()
 				if err != nil {
 					return nil, fmt.Errorf("%s: %w", node.Name, err)
 				}
@@ -495,32 +631,99 @@ func (pm *Pagemanager) Template(name string, r io.Reader) (*template.Template, e
 			return nil, fmt.Errorf("%s: adding %s: %w", name, t.Name(), err)
 		}
 	}
-	page = page.Lookup(name)
-	return page, nil
+	// Global blocks are added last so that they replace the defaults in the
+	// page.
+	for _, global := range globals {
+		for _, t := range global.Templates() {
+			_, err = page.AddParseTree(t.Name(), t.Tree)
+			if err != nil {
+				return nil, fmt.Errorf("%s: adding %s: %w", global.Name(), t.Name(), err)
+			}
+		}
+	}
+	dir := "pm-src"
+	if _, rest, ok := splitSitePrefix(name); ok {
+		dir = path.Dir(rest)
+		overrides, names, err := pm.blockOverrides(path.Dir(name))
+		deps = append(deps, names...)
+		if err != nil {
+			return nil, err
+		}
+		for blockName, value := range overrides {
+			t := page.Lookup(blockName)
+			if !isBlockName(blockName) || t == nil || t.Tree == nil {
+				continue
+			}
+			override, err := blockTemplate(blockName, value, isMultiline(t.Tree.Root.String()))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", names[len(names)-1], err)
+			}
+			_, err = page.AddParseTree(blockName, override.Tree)
+			if err != nil {
+				return nil, fmt.Errorf("%s: adding %s: %w", names[len(names)-1], blockName, err)
+			}
+		}
+	}
+	t, catalogs, err := pm.translator(sitePrefix, lang)
+	if err != nil {
+		return nil, err
+	}
+	deps = append(deps, catalogs...)
+	page.Funcs(map[string]any{
+		"include": pm.include(sitePrefix, dir, t, nil),
+		"t":       t,
+	})
+	includes, query := pm.includeDeps(sitePrefix, dir, page.Templates())
+	deps = append(deps, includes...)
+	return &pageTemplate{tmpl: page.Lookup(name), deps: deps, matter: matter, query: query}, nil
 }
 
 func (pm *Pagemanager) Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
 	statusCode := strconv.Itoa(code)
-	errmsg := statusCode + " " + http.StatusText(code) + "\n\n" + msg
+	errmsg := statusCode + " " + http.StatusText(code)
+	if msg != "" {
+		errmsg += "\n\n" + msg
+	}
 	domain, subdomain := splitHost(r.Host)
-	tildePrefix, _ := splitPath(r.URL.Path)
-	name := path.Join(domain, subdomain, tildePrefix, "pm-src", statusCode+".html")
-	file, err := pm.fs.Open(name)
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	// Error pages are written by the site's owner, so they are sandboxed like
+	// the rest of a tilde site even on the editor paths.
+	if tildePrefix != "" && pm.mode == "online" {
+		w.Header().Set("Content-Security-Policy", tildeSandbox)
+	}
+	file, names, err := openFirst(pm.fs, siteCandidates(path.Join(domain, subdomain, tildePrefix), path.Join("pm-src", statusCode+".html")))
 	if err != nil {
 		http.Error(w, errmsg, code)
 		return
 	}
 	defer file.Close()
+	name := names[len(names)-1]
 	tmpl, err := pm.Template(name, file)
+	if err != nil {
+		if pm.mode == "offline" {
+			errmsg += "\n\n(error parsing " + name + ": " + err.Error() + ")"
+		} else {
+			log.Printf("error parsing %s: %v", name, err)
+		}
+		http.Error(w, errmsg, code)
+		return
+	}
 	buf := bufpool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bufpool.Put(buf)
-	err = tmpl.ExecuteTemplate(buf, name, map[string]any{
+	data := map[string]any{
 		"URL": r.URL,
 		"Msg": msg,
-	})
+	}
+	pm.pageContext(r, data)
+	err = tmpl.ExecuteTemplate(buf, name, data)
 	if err != nil {
-		http.Error(w, errmsg+"\n\n(error executing "+name+": "+err.Error()+")", code)
+		if pm.mode == "offline" {
+			errmsg += "\n\n(error executing " + name + ": " + err.Error() + ")"
+		} else {
+			log.Printf("error executing %s: %v", name, err)
+		}
+		http.Error(w, errmsg, code)
 		return
 	}
 	w.WriteHeader(code)
@@ -533,18 +736,39 @@ func (pm *Pagemanager) NotFound() http.Handler {
 	})
 }
 
+// InternalServerError shows err to the visitor in offline mode. In online mode
+// err is logged and the visitor only sees a generic error page.
 func (pm *Pagemanager) InternalServerError(err error) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		pm.Error(w, r, err.Error(), 500)
+		if pm.mode == "offline" {
+			pm.Error(w, r, err.Error(), 500)
+			return
+		}
+		log.Printf("%s %s%s: %v", r.Method, r.Host, r.URL.RequestURI(), err)
+		pm.Error(w, r, "", 500)
 	})
 }
 
+// Handler returns the handler for name, which is either a file or a page
+// directory such as example.com/pm-src/blog. Pages are rendered in the default
+// language.
 func (pm *Pagemanager) Handler(name string, data map[string]any) (http.Handler, error) {
+	return pm.handler(name, pm.defaultLang(), data)
+}
+
+// handler is like Handler but renders a page in lang, looking for
+// index.<lang>.html and index.<lang>.md before index.html and index.md.
+func (pm *Pagemanager) handler(name, lang string, data map[string]any) (http.Handler, error) {
 	var err error
 	var file fs.File
+	dirs := []string{name}
+	if sitePrefix, rest, ok := splitSitePrefix(name); ok {
+		dirs = siteCandidates(sitePrefix, rest)
+	}
 
 	if filepath.Ext(name) != "" {
-		file, err = pm.fs.Open(name)
+		var names []string
+		file, names, err = openFirst(pm.fs, dirs)
 		if err != nil {
 			return nil, err
 		}
@@ -554,6 +778,20 @@ func (pm *Pagemanager) Handler(name string, data map[string]any) (http.Handler,
 		}
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer file.Close()
+			// The files of an unpublished page, including its source, are
+			// as hidden as the page itself.
+			ok, err := pm.filePublished(name, names[len(names)-1], lang, time.Now())
+			if err != nil {
+				pm.InternalServerError(err).ServeHTTP(w, r)
+				return
+			}
+			if !ok {
+				if !pm.authorize(r) {
+					pm.NotFound().ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("Cache-Control", "no-store")
+			}
 			fileSeeker, ok := file.(io.ReadSeeker)
 			if !ok {
 				w.Header().Set("Content-Type", mime.TypeByExtension(fileinfo.Name()))
@@ -565,14 +803,9 @@ func (pm *Pagemanager) Handler(name string, data map[string]any) (http.Handler,
 		}), nil
 	}
 
-	filenames := []string{"index.html", "index.md", "handler.txt"}
-	for _, filename := range filenames {
-		file, err = pm.fs.Open(path.Join(name, filename))
-		if errors.Is(err, fs.ErrNotExist) {
-			continue
-		}
-		break
-	}
+	// A page in the pm-site override directory shadows the shared page
+	// entirely, whichever of its index files either of them has.
+	file, names, err := openFirst(pm.fs, pageCandidates(dirs, lang))
 	if err != nil {
 		return nil, err
 	}
@@ -583,7 +816,7 @@ func (pm *Pagemanager) Handler(name string, data map[string]any) (http.Handler,
 	}
 	filename := fileinfo.Name()
 	modtime := fileinfo.ModTime()
-	handlerPath := path.Join(name, filename)
+	handlerPath := names[len(names)-1]
 
 	if filename == "handler.txt" {
 		var b strings.Builder
@@ -599,48 +832,193 @@ func (pm *Pagemanager) Handler(name string, data map[string]any) (http.Handler,
 		return handler, nil
 	}
 
-	page, err := pm.Template(handlerPath, file)
-	if err != nil {
-		return nil, err
+	// In online mode compiled pages are cached until the page or one of its
+	// dependencies changes. Concurrent requests for a page that is not
+	// cached wait on a single compilation.
+	// The t function is bound when the page is compiled, so the same file
+	// compiles to a different page in each language.
+	key := handlerPath
+	if lang != "" {
+		key += "\x00" + lang
 	}
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		buf := bufpool.Get().(*bytes.Buffer)
-		buf.Reset()
-		defer bufpool.Put(buf)
-		if data == nil {
-			data = make(map[string]any)
-		}
-		data["URL"] = r.URL
-		err = page.ExecuteTemplate(buf, handlerPath, data)
+	var cached *cachedPage
+	if pm.mode == "online" {
+		cached = pm.cache.get(pm.fs, key, modtime)
+	}
+	if cached == nil {
+		v, err, _ := pm.compile.Do(key, func() (any, error) {
+			page, err := pm.template(handlerPath, lang, file)
+			if err != nil {
+				return nil, err
+			}
+			// Record the index files that were looked for and not found, so
+			// that creating one of them is seen as a change to the page.
+			// The same goes for the index files of the other languages.
+			page.deps = append(names[:len(names)-1:len(names)-1], page.deps...)
+			langs, langDeps := pm.alternates(dirs, handlerPath)
+			page.deps = append(page.deps, langDeps...)
+			cached := newCachedPage(pm.fs, modtime, page)
+			cached.langs = langs
+			if pm.mode == "online" {
+				pm.cache.put(key, cached)
+			}
+			return cached, nil
+		})
 		if err != nil {
-			pm.InternalServerError(err).ServeHTTP(w, r)
+			return nil, err
+		}
+		cached = v.(*cachedPage)
+	}
+	// A page that calls query may show other pages or anything else, so
+	// like a DB route it is served without a modtime.
+	modtime = cached.latest
+	if cached.page.query {
+		modtime = time.Time{}
+	}
+	return &pageHandler{
+		pm:          pm,
+		page:        cached.page,
+		handlerPath: handlerPath,
+		modtime:     modtime,
+		data:        data,
+		livereload:  pm.mode == "offline",
+		lang:        lang,
+		langs:       cached.langs,
+	}, nil
+}
+
+// pageCandidates returns the files that the page in dirs may be rendered from
+// in lang, in order of precedence.
+func pageCandidates(dirs []string, lang string) []string {
+	filenames := []string{"index.html", "index.md", "handler.txt"}
+	if lang != "" {
+		filenames = append([]string{"index." + lang + ".html", "index." + lang + ".md"}, filenames...)
+	}
+	var names []string
+	for _, dir := range dirs {
+		for _, filename := range filenames {
+			names = append(names, path.Join(dir, filename))
+		}
+	}
+	return names
+}
+
+type pageHandler struct {
+	pm          *Pagemanager
+	page        *pageTemplate
+	handlerPath string
+	modtime     time.Time // Zero if the page has no reliable modtime.
+	data        map[string]any
+	livereload  bool     // Inject the live reload script.
+	lang        string   // The language the page is rendered in.
+	langs       []string // The languages the page exists in.
+}
+
+func (h *pageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Drafts and pages outside their publishAt and expireAt times, and the
+	// pages below them, can only be previewed by the site's editors.
+	if !h.published(time.Now()) {
+		if !h.pm.authorize(r) {
+			h.pm.NotFound().ServeHTTP(w, r)
 			return
 		}
-		http.ServeContent(w, r, filename, modtime, bytes.NewReader(buf.Bytes()))
-	}), nil
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	buf := bufpool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer bufpool.Put(buf)
+	data := make(map[string]any)
+	for k, v := range h.data {
+		data[k] = v
+	}
+	data["URL"] = r.URL
+	data["Page"] = h.page.matter
+	pc := h.pm.pageContext(r, data)
+	if len(h.langs) > 1 {
+		alternates := make([]Alternate, len(h.langs))
+		for i, lang := range h.langs {
+			alternates[i] = Alternate{Lang: lang, URL: h.pm.langURL(pc.TildePrefix, lang, pc.Path)}
+		}
+		data["Alternates"] = alternates
+	}
+	err := h.page.tmpl.ExecuteTemplate(buf, h.handlerPath, data)
+	if err != nil {
+		h.pm.InternalServerError(err).ServeHTTP(w, r)
+		return
+	}
+	b := buf.Bytes()
+	if h.livereload {
+		tildePrefix, _, _ := splitPath(r.URL.Path, h.pm.languages)
+		b = injectLivereload(b, tildePrefix)
+	}
+	http.ServeContent(w, r, path.Base(h.handlerPath), h.modtime, bytes.NewReader(b))
 }
 
-func (pm *Pagemanager) Static(w http.ResponseWriter, r *http.Request, name string) {
-	if !strings.HasPrefix(name, "pm-static") {
-		name = path.Join("pm-static", name)
+// published reports whether the page and every page above it is published.
+func (h *pageHandler) published(now time.Time) bool {
+	if !published(h.page.matter, now) {
+		return false
 	}
-	name = strings.TrimPrefix(name, "/")
-	names := make([]string, 0, 2)
-	names = append(names, name)
-	if strings.HasPrefix(name, "pm-static/pm-template") {
-		names = append(names, strings.TrimPrefix(name, "pm-static/"))
+	sitePrefix, rest, ok := splitSitePrefix(h.handlerPath)
+	if !ok || path.Dir(rest) == "pm-src" {
+		return true
 	}
-	var err error
-	var file fs.File
-	for _, name := range names {
-		file, err = pm.fs.Open(name)
-		if errors.Is(err, fs.ErrNotExist) {
-			continue
+	ok, err := h.pm.dirPublished(sitePrefix, h.lang, path.Dir(path.Dir(rest)), now)
+	return ok && err == nil
+}
+
+// dirPublished reports whether the pages of the site-relative directory dir
+// (e.g. pm-src/blog) and of every directory above it are published in lang.
+// An unpublished page hides everything below it.
+func (pm *Pagemanager) dirPublished(sitePrefix, lang, dir string, now time.Time) (bool, error) {
+	for {
+		b, _, err := readFirst(pm.fs, pageCandidates(siteCandidates(sitePrefix, dir), lang))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
 		}
 		if err == nil {
-			break
+			matter, _, err := splitFrontMatter(string(b))
+			if err == nil && !published(matter, now) {
+				return false, nil
+			}
+		}
+		if dir == "pm-src" || !strings.HasPrefix(dir, "pm-src/") {
+			return true, nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// filePublished reports whether the file served for name (opened from
+// filename) is published: its directory must be, and so must the file
+// itself if it is a page with front matter.
+func (pm *Pagemanager) filePublished(name, filename, lang string, now time.Time) (bool, error) {
+	sitePrefix, rest, ok := splitSitePrefix(name)
+	if !ok {
+		return true, nil
+	}
+	ok, err := pm.dirPublished(sitePrefix, lang, path.Dir(rest), now)
+	if err != nil || !ok {
+		return false, err
+	}
+	switch path.Ext(filename) {
+	case ".md", ".html":
+		b, err := fs.ReadFile(pm.fs, filename)
+		if err != nil {
+			return false, err
+		}
+		matter, _, err := splitFrontMatter(string(b))
+		if err == nil && !published(matter, now) {
+			return false, nil
 		}
 	}
+	return true, nil
+}
+
+func (pm *Pagemanager) Static(w http.ResponseWriter, r *http.Request, name string) {
+	domain, subdomain := splitHost(r.Host)
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	file, _, err := openFirst(pm.fs, staticCandidates(path.Join(domain, subdomain, tildePrefix), name))
 	if errors.Is(err, fs.ErrNotExist) {
 		pm.NotFound().ServeHTTP(w, r)
 		return
@@ -649,6 +1027,7 @@ func (pm *Pagemanager) Static(w http.ResponseWriter, r *http.Request, name strin
 		pm.InternalServerError(err).ServeHTTP(w, r)
 		return
 	}
+	defer file.Close()
 	fileinfo, err := file.Stat()
 	if err != nil {
 		pm.InternalServerError(err).ServeHTTP(w, r)
@@ -682,7 +1061,9 @@ func (pm *Pagemanager) debug(w http.ResponseWriter, r *http.Request) {
 	filename := r.Form.Get("f")
 	templateName := r.Form.Get("t")
 	step := r.Form.Get("s")
-	file, err := pm.fs.Open(path.Join("pm-src", filename))
+	domain, subdomain := splitHost(r.Host)
+	tildePrefix, _, _ := splitPath(r.URL.Path, pm.languages)
+	file, _, err := openFirst(pm.fs, siteCandidates(path.Join(domain, subdomain, tildePrefix), path.Join("pm-src", filename)))
 	if err != nil {
 		pm.InternalServerError(err).ServeHTTP(w, r)
 		return
@@ -732,33 +1113,98 @@ func (pm *Pagemanager) debug(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = t.ExecuteTemplate(w, templateName, map[string]any{
+	data := map[string]any{
 		"URL": r.URL,
-	})
+	}
+	pm.pageContext(r, data)
+	err = t.ExecuteTemplate(w, templateName, data)
 	if err != nil {
 		_, _ = io.WriteString(w, "\n\n"+err.Error())
 	}
 }
 
+// tildeSandbox is the Content-Security-Policy of tilde site responses. It
+// allows scripts but not allow-same-origin.
+const tildeSandbox = "sandbox allow-scripts allow-forms allow-modals allow-popups allow-popups-to-escape-sandbox allow-downloads allow-top-navigation-by-user-activation"
+
+// isEditorPath reports whether pathName is served by pagemanager itself for
+// the site's editors rather than by the site.
+func isEditorPath(pathName string) bool {
+	return pathName == "pm-admin" || strings.HasPrefix(pathName, "pm-admin/") || strings.HasPrefix(pathName, "pm-api/") ||
+		pathName == "pm-login" || pathName == "pm-logout"
+}
+
 func (pm *Pagemanager) Pagemanager(next http.Handler) http.Handler {
-	pm.wfs, _ = pm.fs.(WriteableFS)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		domain, subdomain := splitHost(r.Host)
-		tildePrefix, pathName := splitPath(r.URL.Path)
+		tildePrefix, lang, pathName := splitPath(r.URL.Path, pm.languages)
+		// Tilde sites share one origin with each other and with pm-admin,
+		// and their owners may write any HTML and JS. Online, everything a
+		// tilde site serves is sandboxed into an origin of its own, so that
+		// a script on /~bob/ cannot use alice's session to edit /~alice/.
+		if tildePrefix != "" && pm.mode == "online" && !isEditorPath(pathName) {
+			w.Header().Set("Content-Security-Policy", tildeSandbox)
+		}
 		// pm-debug.
-		if pathName == "pm-debug" || strings.HasPrefix(pathName, "pm-debug/") {
+		if pm.mode == "offline" && (pathName == "pm-debug" || strings.HasPrefix(pathName, "pm-debug/")) {
 			pm.debug(w, r)
 			return
 		}
+		// pm-livereload.
+		if pathName == "pm-livereload" && pm.mode == "offline" {
+			pm.livereload(w, r)
+			return
+		}
 		// pm-static.
 		if pathName == "pm-static" || strings.HasPrefix(pathName, "pm-static/") {
 			pm.Static(w, r, pathName)
 			return
 		}
-		// pm-site.
-		// pm-src.
+		// pm-admin.
+		if pathName == "pm-admin" || strings.HasPrefix(pathName, "pm-admin/") {
+			pm.admin(w, r, tildePrefix, pathName)
+			return
+		}
+		// pm-login and pm-logout.
+		if pathName == "pm-login" {
+			pm.login(w, r, path.Join(domain, subdomain, tildePrefix))
+			return
+		}
+		if pathName == "pm-logout" {
+			pm.logout(w, r)
+			return
+		}
+		// pm-api.
+		if strings.HasPrefix(pathName, "pm-api/") {
+			pm.api(w, r, path.Join(domain, subdomain, tildePrefix), strings.TrimPrefix(pathName, "pm-api/"))
+			return
+		}
+		// Files and directories starting with pm- are reserved (e.g.
+		// pm-src/pm-i18n) and are never served as pages.
+		for _, segment := range strings.Split(pathName, "/") {
+			if strings.HasPrefix(segment, "pm-") {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if lang == "" {
+			lang = pm.defaultLang()
+		}
+		// pm_route.
+		if pm.db != nil {
+			handler, err := pm.dbHandler(r.Context(), domain, subdomain, tildePrefix, lang, pathName)
+			if err == nil {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				pm.InternalServerError(err).ServeHTTP(w, r)
+				return
+			}
+		}
+		// pm-src, shadowed by pm-site.
 		name := path.Join(domain, subdomain, tildePrefix, "pm-src", pathName)
-		handler, err := pm.Handler(name, nil)
+		handler, err := pm.handler(name, lang, nil)
 		if errors.Is(err, fs.ErrNotExist) {
 			next.ServeHTTP(w, r)
 			return
@@ -784,12 +1230,21 @@ func splitHost(host string) (domain, subdomain string) {
 	return domain, subdomain
 }
 
-func splitPath(rawPath string) (tildePrefix, pathName string) {
+// splitPath splits a URL path into its tilde prefix, language code and the
+// path of the page. The language code is only recognized if it is one of
+// languages.
+func splitPath(rawPath string, languages []string) (tildePrefix, lang, pathName string) {
 	pathName = strings.TrimPrefix(rawPath, "/")
 	if strings.HasPrefix(pathName, "~") {
 		if i := strings.Index(pathName, "/"); i >= 0 {
 			tildePrefix, pathName = pathName[:i], pathName[i+1:]
 		}
 	}
-	return tildePrefix, pathName
+	segment, rest, _ := strings.Cut(pathName, "/")
+	for _, language := range languages {
+		if segment == language {
+			return tildePrefix, segment, rest
+		}
+	}
+	return tildePrefix, "", pathName
 }
@@ -0,0 +1,220 @@
+// The admin UI talks to the JSON API at /pm-api/ of the same site. The admin
+// is served at <site>/pm-admin/, so the site root is two levels up.
+const siteRoot = new URL("..", location.href).pathname;
+const api = siteRoot + "pm-api/";
+
+// Every request that changes something carries the CSRF token of the session.
+const session = fetch(api + "session").then((response) => response.json());
+
+async function request(method, endpoint, params, body) {
+  const url = api + endpoint + "?" + new URLSearchParams(params);
+  const headers = { "X-CSRF-Token": (await session).csrfToken };
+  if (body) {
+    headers["Content-Type"] = "application/json";
+  }
+  const response = await fetch(url, {
+    method: method,
+    headers: headers,
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  const data = await response.json();
+  if (!response.ok) {
+    throw data.error;
+  }
+  return data;
+}
+
+function el(tag, props, ...children) {
+  const node = document.createElement(tag);
+  Object.assign(node, props);
+  node.append(...children);
+  return node;
+}
+
+// Tree.
+
+async function loadDir(ul, dir) {
+  const { entries } = await request("GET", "dir", { path: dir });
+  ul.replaceChildren();
+  for (const entry of entries) {
+    const name = dir ? dir + "/" + entry.name : entry.name;
+    const li = el("li");
+    if (entry.dir) {
+      const sub = el("ul", { hidden: true });
+      const a = el("a", { className: "dir", textContent: entry.name });
+      a.onclick = async () => {
+        select(a);
+        if (sub.hidden) {
+          await loadDir(sub, name);
+        }
+        sub.hidden = !sub.hidden;
+        a.classList.toggle("open", !sub.hidden);
+        if (entry.page) {
+          showPage(name);
+        }
+      };
+      li.append(a, sub);
+    } else {
+      const a = el("a", { textContent: entry.name });
+      a.onclick = () => {
+        select(a);
+        showFile(name);
+      };
+      li.append(a);
+    }
+    ul.append(li);
+  }
+}
+
+function select(a) {
+  document.querySelectorAll("nav a.selected").forEach((node) => node.classList.remove("selected"));
+  a.classList.add("selected");
+}
+
+function show(id) {
+  for (const section of ["placeholder", "page", "file"]) {
+    document.getElementById(section).hidden = section !== id;
+  }
+}
+
+// Pages.
+
+let currentPage = null;
+
+async function showPage(pathName) {
+  currentPage = pathName;
+  const url = siteRoot + pathName;
+  document.getElementById("page-title").textContent = "/" + pathName;
+  document.getElementById("page-link").href = url;
+  document.getElementById("preview").src = url;
+  document.getElementById("blocks-status").textContent = "";
+  const { blocks } = await request("GET", "blocks", { path: pathName });
+  const fields = document.getElementById("block-fields");
+  fields.replaceChildren();
+  if (blocks.length === 0) {
+    fields.append(el("p", { textContent: "This page has no editable blocks." }));
+  }
+  for (const block of blocks) {
+    const value = block.overridden ? block.value : "";
+    const input = block.multiline
+      ? el("textarea", { name: block.name, value: value, placeholder: block.default })
+      : el("input", { type: "text", name: block.name, value: value, placeholder: block.default });
+    fields.append(
+      el("label", { textContent: block.name }),
+      input,
+      el("div", { className: "default", textContent: "Leave empty to use the default." }),
+    );
+  }
+  show("page");
+}
+
+document.getElementById("blocks").onsubmit = async (event) => {
+  event.preventDefault();
+  const status = document.getElementById("blocks-status");
+  const blocks = {};
+  for (const input of document.querySelectorAll("#block-fields [name]")) {
+    if (input.value !== "") {
+      blocks[input.name] = input.value;
+    }
+  }
+  try {
+    await request("POST", "blocks", { path: currentPage }, { blocks: blocks });
+    status.textContent = "Saved.";
+    // Tilde site pages are sandboxed into another origin, so the preview is
+    // reloaded by resetting its src rather than through contentWindow.
+    const preview = document.getElementById("preview");
+    preview.src = preview.src;
+  } catch (error) {
+    status.textContent = error.message;
+  }
+};
+
+// Files.
+
+let currentFile = null;
+
+async function showFile(pathName) {
+  currentFile = pathName;
+  document.getElementById("file-title").textContent = pathName;
+  document.getElementById("file-status").textContent = "";
+  document.getElementById("file-errors").replaceChildren();
+  const textarea = document.getElementById("file-content");
+  try {
+    const { content } = await request("GET", "file", { path: pathName });
+    textarea.value = content;
+    textarea.disabled = false;
+  } catch (error) {
+    textarea.value = error.message;
+    textarea.disabled = true;
+  }
+  await loadRevisions();
+  show("file");
+}
+
+// History.
+
+async function loadRevisions() {
+  const list = document.getElementById("revisions");
+  const diff = document.getElementById("diff");
+  diff.hidden = true;
+  const { revisions } = await request("GET", "revisions", { path: currentFile });
+  list.replaceChildren();
+  for (const revision of revisions.slice().reverse()) {
+    const time = new Date(revision.time).toLocaleString();
+    const li = el("li", {}, time + (revision.deleted ? " (deleted) " : " (" + revision.size + " bytes) "));
+    if (revision.id > 1) {
+      const show = el("button", { type: "button", textContent: "Changes" });
+      show.onclick = async () => {
+        const data = await request("GET", "diff", { path: currentFile, from: revision.id - 1, to: revision.id });
+        diff.textContent = data.diff || "No changes.";
+        diff.hidden = false;
+      };
+      li.append(show);
+    }
+    if (revision.id < revisions.length) {
+      const restore = el("button", { type: "button", textContent: "Restore" });
+      restore.onclick = async () => {
+        await request("POST", "restore", { path: currentFile }, { revision: revision.id });
+        await showFile(currentFile);
+        document.getElementById("file-status").textContent = "Restored.";
+      };
+      li.append(restore);
+    }
+    list.append(li);
+  }
+}
+
+document.getElementById("file-form").onsubmit = async (event) => {
+  event.preventDefault();
+  const status = document.getElementById("file-status");
+  const errors = document.getElementById("file-errors");
+  errors.replaceChildren();
+  try {
+    await request("POST", "file", { path: currentFile }, { content: document.getElementById("file-content").value });
+    status.textContent = "Saved.";
+    await loadRevisions();
+  } catch (error) {
+    status.textContent = error.message;
+    for (const e of error.errors || []) {
+      const location = e.file ? e.file + (e.line ? ":" + e.line : "") + ": " : "";
+      errors.append(el("li", { textContent: location + e.message }));
+    }
+  }
+};
+
+const home = el("a", { textContent: "/" });
+home.onclick = () => {
+  select(home);
+  showPage("");
+};
+document.getElementById("root").before(home);
+session.then(({ user, csrfToken }) => {
+  if (user) {
+    const logout = document.getElementById("logout");
+    logout.action = siteRoot + "pm-logout";
+    logout.elements.csrf_token.value = csrfToken;
+    document.getElementById("username").textContent = user.username;
+    logout.hidden = false;
+  }
+});
+loadDir(document.getElementById("root"), "");
@@ -0,0 +1,420 @@
+package pagemanager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every file written or removed through writeFile and removeFile gets a
+// revision. Revisions are kept in the pm-revision directory of the file's
+// site (e.g. ~alice/pm-revision), which does not count towards its quota. The
+// contents are stored once per hash under pm-revision/blob/<hash[:2]>/<hash[2:]>
+// and each file has a log of its revisions at pm-revision/log/<name>.json,
+// oldest first, where name is relative to the site. The first time an
+// existing file is changed its current contents are recorded too, so that
+// the original can always be restored.
+const revisionDir = "pm-revision"
+
+var errNoSuchRevision = errors.New("no such revision")
+
+// Revision is a version of a file. Revisions are numbered from 1.
+type Revision struct {
+	ID      int       `json:"id"`
+	Hash    string    `json:"hash,omitempty"` // Empty if the file was removed.
+	Size    int64     `json:"size"`
+	Time    time.Time `json:"time"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// revisionRoot returns the pm-revision directory of the site that name
+// belongs to, and name relative to the site. Files under pm-site keep a
+// pm-site/ prefix so that they do not share a log with the file they shadow.
+func revisionRoot(name string) (root, rel string) {
+	sitePrefix, rest, ok := splitSitePrefix(name)
+	if !ok {
+		sitePrefix = tildeSitePrefix(name)
+		rest = strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(name, "pm-site/"), sitePrefix), "/")
+	}
+	if strings.HasPrefix(name, "pm-site/") {
+		rest = path.Join("pm-site", rest)
+	}
+	return path.Join(sitePrefix, revisionDir), rest
+}
+
+func revisionLogName(name string) string {
+	root, rel := revisionRoot(name)
+	return path.Join(root, "log", rel+".json")
+}
+
+func revisionBlobName(name, hash string) string {
+	root, _ := revisionRoot(name)
+	return path.Join(root, "blob", hash[:2], hash[2:])
+}
+
+// Revisions returns the revisions of the file, oldest first.
+func (pm *Pagemanager) Revisions(name string) ([]Revision, error) {
+	b, err := fs.ReadFile(pm.fs, revisionLogName(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision
+	err = json.Unmarshal(b, &revisions)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", revisionLogName(name), err)
+	}
+	return revisions, nil
+}
+
+// RevisionContent returns the contents of a revision of the file.
+func (pm *Pagemanager) RevisionContent(name string, id int) ([]byte, error) {
+	revisions, err := pm.Revisions(name)
+	if err != nil {
+		return nil, err
+	}
+	if id < 1 || id > len(revisions) {
+		return nil, fmt.Errorf("%s: revision %d: %w", name, id, errNoSuchRevision)
+	}
+	revision := revisions[id-1]
+	if revision.Deleted {
+		return nil, nil
+	}
+	return fs.ReadFile(pm.fs, revisionBlobName(name, revision.Hash))
+}
+
+// Restore makes a revision of the file current again, which itself is
+// recorded as a new revision.
+func (pm *Pagemanager) Restore(name string, id int) error {
+	revisions, err := pm.Revisions(name)
+	if err != nil {
+		return err
+	}
+	if id < 1 || id > len(revisions) {
+		return fmt.Errorf("%s: revision %d: %w", name, id, errNoSuchRevision)
+	}
+	if revisions[id-1].Deleted {
+		return pm.removeFile(name)
+	}
+	b, err := pm.RevisionContent(name, id)
+	if err != nil {
+		return err
+	}
+	return pm.writeFile(name, b)
+}
+
+// record adds a revision to the log of the file, unless it is the same as
+// the latest one. data is ignored if deleted is true. It must be called with
+// pm.revisionMu held, before the file is changed. It returns a function that
+// restores the log, to be called if changing the file fails so that the log
+// does not end with a revision that never became current.
+func (pm *Pagemanager) record(name string, data []byte, deleted bool) (undo func() error, err error) {
+	logName := revisionLogName(name)
+	oldLog, err := fs.ReadFile(pm.fs, logName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	undo = func() error {
+		if oldLog == nil {
+			return pm.wfs.RemoveAll(logName)
+		}
+		return pm.wfs.WriteFile(logName, oldLog, 0644)
+	}
+	revisions, err := pm.Revisions(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		b, err := fs.ReadFile(pm.fs, name)
+		if err == nil {
+			revision := Revision{Hash: hashContent(b), Size: int64(len(b)), Time: time.Now()}
+			if fileinfo, err := fs.Stat(pm.fs, name); err == nil {
+				revision.Time = fileinfo.ModTime()
+			}
+			err = pm.writeBlob(name, revision.Hash, b)
+			if err != nil {
+				return nil, err
+			}
+			revisions = append(revisions, revision)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	revision := Revision{Time: time.Now(), Deleted: deleted}
+	if !deleted {
+		revision.Hash = hashContent(data)
+		revision.Size = int64(len(data))
+	}
+	if n := len(revisions); n > 0 && revisions[n-1].Hash == revision.Hash && revisions[n-1].Deleted == revision.Deleted {
+		return func() error { return nil }, nil
+	}
+	if !deleted {
+		err = pm.writeBlob(name, revision.Hash, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	revisions = append(revisions, revision)
+	for i := range revisions {
+		revisions[i].ID = i + 1
+	}
+	b, err := json.MarshalIndent(revisions, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = pm.wfs.MkdirAll(path.Dir(logName), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = pm.wfs.WriteFile(logName, b, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return undo, nil
+}
+
+// writeBlob stores the contents of a revision of the file name.
+func (pm *Pagemanager) writeBlob(name, hash string, data []byte) error {
+	name = revisionBlobName(name, hash)
+	if _, err := fs.Stat(pm.fs, name); err == nil {
+		return nil
+	}
+	err := pm.wfs.MkdirAll(path.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	return pm.wfs.WriteFile(name, data, 0644)
+}
+
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// maxDiffCells limits the size of the table that unifiedDiff compares the
+// changed lines of two files with.
+const maxDiffCells = 4 << 20
+
+var errDiffTooLarge = errors.New("the revisions are too different to diff")
+
+// unifiedDiff returns the line diff between a and b in unified diff format,
+// with three lines of context around each change. Lines common to the start
+// and end of both are skipped before the rest is compared, and it returns
+// errDiffTooLarge if that would take more than maxDiffCells.
+func unifiedDiff(nameA, nameB string, a, b []byte) (string, error) {
+	linesA, linesB := splitLines(a), splitLines(b)
+	prefix := 0
+	for prefix < len(linesA) && prefix < len(linesB) && linesA[prefix] == linesB[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(linesA)-prefix && suffix < len(linesB)-prefix && linesA[len(linesA)-1-suffix] == linesB[len(linesB)-1-suffix] {
+		suffix++
+	}
+	midA, midB := linesA[prefix:len(linesA)-suffix], linesB[prefix:len(linesB)-suffix]
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		return "", errDiffTooLarge
+	}
+	// lcs[i*width+j] is the length of the longest common subsequence of
+	// midA[i:] and midB[j:].
+	width := len(midB) + 1
+	lcs := make([]int32, (len(midA)+1)*width)
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+				lcs[i*width+j] = lcs[(i+1)*width+j]
+			} else {
+				lcs[i*width+j] = lcs[i*width+j+1]
+			}
+		}
+	}
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		i, j int // Line numbers in a and b before this edit.
+	}
+	var edits []edit
+	for k := 0; k < prefix; k++ {
+		edits = append(edits, edit{' ', linesA[k], k, k})
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+			edits = append(edits, edit{' ', midA[i], prefix + i, prefix + j})
+			i++
+			j++
+		case i < len(midA) && (j == len(midB) || lcs[(i+1)*width+j] >= lcs[i*width+j+1]):
+			edits = append(edits, edit{'-', midA[i], prefix + i, prefix + j})
+			i++
+		default:
+			edits = append(edits, edit{'+', midB[j], prefix + i, prefix + j})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		i, j := len(linesA)-suffix+k, len(linesB)-suffix+k
+		edits = append(edits, edit{' ', linesA[i], i, j})
+	}
+
+	const context = 3
+	var buf bytes.Buffer
+	for start := 0; start < len(edits); {
+		// Find the next change and the extent of its hunk.
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		begin := start - context
+		if begin < 0 {
+			begin = 0
+		}
+		end := start
+		for k := start; k < len(edits) && k-end <= 2*context; k++ {
+			if edits[k].op != ' ' {
+				end = k + 1
+			}
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		countA, countB := 0, 0
+		for _, e := range edits[begin:stop] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(edits[begin].i, countA), hunkRange(edits[begin].j, countB))
+		for _, e := range edits[begin:stop] {
+			buf.WriteByte(e.op)
+			buf.WriteString(e.line)
+			buf.WriteByte('\n')
+		}
+		start = stop
+	}
+	return buf.String(), nil
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// apiRevisions serves the revisions, diff and restore endpoints for the
+// site-relative file name. The file is the one currently in effect, or the
+// one that was removed most recently.
+func (pm *Pagemanager) apiRevisions(r *http.Request, endpoint, sitePrefix, name string) (any, error) {
+	names := siteCandidates(sitePrefix, name)
+	filename := names[len(names)-1]
+	for _, candidate := range names {
+		_, err := fs.Stat(pm.fs, candidate)
+		if err == nil {
+			filename = candidate
+			break
+		}
+		if _, err := fs.Stat(pm.fs, revisionLogName(candidate)); err == nil {
+			filename = candidate
+			break
+		}
+	}
+	switch endpoint {
+	case "revisions":
+		revisions, err := pm.Revisions(filename)
+		if err != nil {
+			return nil, err
+		}
+		if revisions == nil {
+			revisions = []Revision{}
+		}
+		return map[string]any{"path": name, "file": filename, "revisions": revisions}, nil
+	case "diff":
+		revisions, err := pm.Revisions(filename)
+		if err != nil {
+			return nil, err
+		}
+		query := r.URL.Query()
+		from, err := strconv.Atoi(query.Get("from"))
+		if err != nil {
+			return nil, &apiError{status: http.StatusBadRequest, Code: "invalid_revision", Message: fmt.Sprintf("invalid from %q", query.Get("from"))}
+		}
+		to := len(revisions)
+		if query.Has("to") {
+			to, err = strconv.Atoi(query.Get("to"))
+			if err != nil {
+				return nil, &apiError{status: http.StatusBadRequest, Code: "invalid_revision", Message: fmt.Sprintf("invalid to %q", query.Get("to"))}
+			}
+		}
+		a, err := pm.RevisionContent(filename, from)
+		if err != nil {
+			return nil, err
+		}
+		b, err := pm.RevisionContent(filename, to)
+		if err != nil {
+			return nil, err
+		}
+		diff, err := unifiedDiff(fmt.Sprintf("%s@%d", name, from), fmt.Sprintf("%s@%d", name, to), a, b)
+		if errors.Is(err, errDiffTooLarge) {
+			return nil, &apiError{status: http.StatusRequestEntityTooLarge, Code: "diff_too_large", Message: err.Error()}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"path": name, "from": from, "to": to, "diff": diff}, nil
+	case "restore":
+		if r.Method != "POST" {
+			return nil, &apiError{status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: r.Method + " not allowed"}
+		}
+		var body struct {
+			Revision int `json:"revision"`
+		}
+		err := decodeJSON(r, &body)
+		if err != nil {
+			return nil, err
+		}
+		err = pm.Restore(filename, body.Revision)
+		if err != nil {
+			return nil, err
+		}
+		revisions, err := pm.Revisions(filename)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"path": name, "file": filename, "revisions": revisions}, nil
+	}
+	return nil, fs.ErrNotExist
+}
@@ -0,0 +1,199 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// Route is a row of pm_route. ParentRouteID is empty for the routes at the
+// root of a site. Path is maintained by the database from the basenames of
+// the route and its ancestors, e.g. blog/2022/hello-world.
+type Route struct {
+	SiteID        string
+	RouteID       string
+	ParentRouteID string
+	Basename      string
+	Path          string
+	Template      string
+	Data          string // JSON.
+	Handler       string
+}
+
+// Routes manages the tree of routes in pm_route. The triggers in
+// sqlite_migrations/repeatable keep pm_route_closure and the path of every
+// route in sync as routes are created, renamed, moved and deleted.
+type Routes struct{ db *sql.DB }
+
+func NewRoutes(db *sql.DB) *Routes { return &Routes{db: db} }
+
+const routeColumns = "pm_route.site_id, pm_route.route_id, COALESCE(pm_route.parent_route_id, '')" +
+	", COALESCE(pm_route.basename, ''), COALESCE(pm_route.path, ''), COALESCE(pm_route.template, '')" +
+	", COALESCE(pm_route.data, ''), COALESCE(pm_route.handler, '')"
+
+func (routes *Routes) query(ctx context.Context, query string, args ...any) ([]Route, error) {
+	rows, err := routes.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []Route
+	for rows.Next() {
+		var route Route
+		err = rows.Scan(&route.SiteID, &route.RouteID, &route.ParentRouteID, &route.Basename, &route.Path, &route.Template, &route.Data, &route.Handler)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, route)
+	}
+	return result, rows.Err()
+}
+
+// Get returns the route with the given ID. It returns an error wrapping
+// fs.ErrNotExist if there is no such route.
+func (routes *Routes) Get(ctx context.Context, routeID string) (Route, error) {
+	result, err := routes.query(ctx, "SELECT "+routeColumns+" FROM pm_route WHERE route_id = ?", routeID)
+	if err != nil {
+		return Route{}, err
+	}
+	if len(result) == 0 {
+		return Route{}, fmt.Errorf("route %q: %w", routeID, fs.ErrNotExist)
+	}
+	return result[0], nil
+}
+
+// Create inserts route under route.ParentRouteID, generating a RouteID if it
+// is empty, and returns the route as stored.
+func (routes *Routes) Create(ctx context.Context, route Route) (Route, error) {
+	err := validBasename(route.Basename)
+	if err != nil {
+		return Route{}, err
+	}
+	if route.RouteID == "" {
+		route.RouteID, err = newUUID()
+		if err != nil {
+			return Route{}, err
+		}
+	}
+	if route.ParentRouteID != "" {
+		parent, err := routes.Get(ctx, route.ParentRouteID)
+		if err != nil {
+			return Route{}, err
+		}
+		if parent.SiteID != route.SiteID {
+			return Route{}, fmt.Errorf("route %q: parent belongs to a different site", route.Basename)
+		}
+	}
+	_, err = routes.db.ExecContext(ctx, "INSERT INTO pm_route (site_id, route_id, parent_route_id, basename, template, data, handler)"+
+		" VALUES (?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''))",
+		route.SiteID, route.RouteID, route.ParentRouteID, route.Basename, route.Template, route.Data, route.Handler,
+	)
+	if err != nil {
+		return Route{}, err
+	}
+	return routes.Get(ctx, route.RouteID)
+}
+
+// Rename changes the basename of a route, which changes the path of the route
+// and all of its descendants.
+func (routes *Routes) Rename(ctx context.Context, routeID, basename string) error {
+	err := validBasename(basename)
+	if err != nil {
+		return err
+	}
+	return routes.exec(ctx, routeID, "UPDATE pm_route SET basename = ? WHERE route_id = ?", basename, routeID)
+}
+
+// Move moves a route and its descendants under a new parent, or to the root of
+// the site if parentRouteID is empty. A route cannot be moved under one of its
+// own descendants.
+func (routes *Routes) Move(ctx context.Context, routeID, parentRouteID string) error {
+	if parentRouteID != "" {
+		route, err := routes.Get(ctx, routeID)
+		if err != nil {
+			return err
+		}
+		parent, err := routes.Get(ctx, parentRouteID)
+		if err != nil {
+			return err
+		}
+		if parent.SiteID != route.SiteID {
+			return fmt.Errorf("route %q: parent belongs to a different site", routeID)
+		}
+	}
+	return routes.exec(ctx, routeID, "UPDATE pm_route SET parent_route_id = NULLIF(?, '') WHERE route_id = ?", parentRouteID, routeID)
+}
+
+// Delete deletes a route together with all of its descendants.
+func (routes *Routes) Delete(ctx context.Context, routeID string) error {
+	return routes.exec(ctx, routeID, "DELETE FROM pm_route WHERE route_id = ?"+
+		" OR route_id IN (SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = ?)",
+		routeID, routeID,
+	)
+}
+
+// exec runs a statement that modifies routeID, reporting fs.ErrNotExist if no
+// such route exists.
+func (routes *Routes) exec(ctx context.Context, routeID, query string, args ...any) error {
+	result, err := routes.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("route %q: %w", routeID, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// Children returns the routes directly under a route ordered by basename. If
+// routeID is empty it returns the routes at the root of the site.
+func (routes *Routes) Children(ctx context.Context, siteID, routeID string) ([]Route, error) {
+	if routeID == "" {
+		return routes.query(ctx, "SELECT "+routeColumns+" FROM pm_route"+
+			" WHERE site_id = ? AND parent_route_id IS NULL ORDER BY basename", siteID)
+	}
+	return routes.query(ctx, "SELECT "+routeColumns+" FROM pm_route"+
+		" WHERE site_id = ? AND parent_route_id = ? ORDER BY basename", siteID, routeID)
+}
+
+// Ancestors returns the ancestors of a route starting from the root.
+func (routes *Routes) Ancestors(ctx context.Context, routeID string) ([]Route, error) {
+	return routes.query(ctx, "SELECT "+routeColumns+" FROM pm_route_closure"+
+		" JOIN pm_route ON pm_route.route_id = pm_route_closure.ancestor_route_id"+
+		" WHERE pm_route_closure.route_id = ? ORDER BY pm_route_closure.depth", routeID)
+}
+
+// Descendants returns every route below a route ordered by path.
+func (routes *Routes) Descendants(ctx context.Context, routeID string) ([]Route, error) {
+	return routes.query(ctx, "SELECT "+routeColumns+" FROM pm_route_closure"+
+		" JOIN pm_route ON pm_route.route_id = pm_route_closure.route_id"+
+		" WHERE pm_route_closure.ancestor_route_id = ? ORDER BY pm_route.path", routeID)
+}
+
+func validBasename(basename string) error {
+	if basename == "" || basename == "." || basename == ".." || strings.Contains(basename, "/") {
+		return fmt.Errorf("invalid basename %q", basename)
+	}
+	return nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:], nil
+}
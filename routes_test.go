@@ -0,0 +1,98 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// paths returns the paths of routes, joined for easy comparison.
+func paths(routes []Route) string {
+	var s []string
+	for _, route := range routes {
+		s = append(s, route.Path)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestRoutes(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	routes := NewRoutes(db)
+	create := func(basename, parentRouteID string) Route {
+		t.Helper()
+		route, err := routes.Create(ctx, Route{SiteID: "1", Basename: basename, ParentRouteID: parentRouteID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return route
+	}
+	check := func(what string, got []Route, err error, want string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		if paths(got) != want {
+			t.Errorf("%s: got %q, want %q", what, paths(got), want)
+		}
+	}
+	blog := create("blog", "")
+	year := create("2022", blog.RouteID)
+	post := create("hello", year.RouteID)
+	about := create("about", "")
+	if post.Path != "blog/2022/hello" {
+		t.Fatalf("created path: got %q, want %q", post.Path, "blog/2022/hello")
+	}
+
+	// Move.
+	err := routes.Move(ctx, year.RouteID, about.RouteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := routes.Ancestors(ctx, post.RouteID)
+	check("ancestors after move", got, err, "about about/2022")
+	got, err = routes.Descendants(ctx, about.RouteID)
+	check("descendants after move", got, err, "about/2022 about/2022/hello")
+	got, err = routes.Descendants(ctx, blog.RouteID)
+	check("descendants of the old parent", got, err, "")
+
+	// Moving a route under its own descendant fails.
+	err = routes.Move(ctx, about.RouteID, post.RouteID)
+	if err == nil {
+		t.Error("moving a route under its descendant: got no error")
+	}
+
+	// Re-root.
+	err = routes.Move(ctx, year.RouteID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = routes.Ancestors(ctx, post.RouteID)
+	check("ancestors after re-root", got, err, "2022")
+	got, err = routes.Descendants(ctx, year.RouteID)
+	check("descendants after re-root", got, err, "2022/hello")
+	got, err = routes.Descendants(ctx, about.RouteID)
+	check("descendants of the old parent", got, err, "")
+
+	// Delete.
+	err = routes.Delete(ctx, year.RouteID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = routes.Get(ctx, post.RouteID)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("get deleted descendant: got %v, want fs.ErrNotExist", err)
+	}
+	var n int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pm_route_closure WHERE route_id IN (?, ?) OR ancestor_route_id IN (?, ?)",
+		year.RouteID, post.RouteID, year.RouteID, post.RouteID,
+	).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("closure rows of deleted routes: got %d, want 0", n)
+	}
+}
@@ -0,0 +1,243 @@
+package pagemanager
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A site is identified by its domain, subdomain and tilde prefix. Its pages
+// live in <domain>/<subdomain>/<~tilde>/pm-src while pm-template and
+// pm-static are shared by every site. Files under
+// pm-site/<domain>/<subdomain>/<~tilde>/ shadow all three for that site only,
+// so many sites can share a theme and still customize individual files.
+type site struct {
+	domain      string
+	subdomain   string
+	tildePrefix string
+}
+
+func (s site) prefix() string {
+	return path.Join(s.domain, s.subdomain, s.tildePrefix)
+}
+
+func (s site) host() string {
+	if s.domain == "" {
+		return "localhost"
+	}
+	if s.subdomain == "" {
+		return s.domain
+	}
+	return s.subdomain + "." + s.domain
+}
+
+// sites returns every site in fsys that has a pm-src directory, either of its
+// own or under pm-site. Domains are top level directories containing a dot,
+// subdomains are the directories inside a domain and tilde prefixes are
+// directories starting with ~ inside the root, a domain or a subdomain.
+func sites(fsys fs.FS) ([]site, error) {
+	var sites []site
+	seen := make(map[site]struct{})
+	var walk func(root string, s site, depth int) error
+	walk = func(root string, s site, depth int) error {
+		dir := path.Join(root, s.prefix())
+		if dir == "" {
+			dir = "."
+		}
+		if _, ok := seen[s]; !ok {
+			if fileinfo, err := fs.Stat(fsys, path.Join(dir, "pm-src")); err == nil && fileinfo.IsDir() {
+				seen[s] = struct{}{}
+				sites = append(sites, s)
+			}
+		}
+		if s.tildePrefix != "" {
+			return nil
+		}
+		entries, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "pm-") {
+				continue
+			}
+			switch {
+			case strings.HasPrefix(name, "~"):
+				err = walk(root, site{domain: s.domain, subdomain: s.subdomain, tildePrefix: name}, depth+1)
+			case depth == 0 && strings.Contains(name, "."):
+				err = walk(root, site{domain: name}, depth+1)
+			case depth == 1:
+				err = walk(root, site{domain: s.domain, subdomain: name}, depth+1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, root := range []string{"", "pm-site"} {
+		err := walk(root, site{}, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sites, nil
+}
+
+// splitSitePrefix splits a name like example.com/~bob/pm-src/blog into the
+// site prefix example.com/~bob and the site-relative name pm-src/blog. A
+// leading pm-site/ is ignored. It reports false if name has no pm-src segment.
+func splitSitePrefix(name string) (sitePrefix, rest string, ok bool) {
+	name = strings.TrimPrefix(name, "pm-site/")
+	if name == "pm-src" || strings.HasPrefix(name, "pm-src/") {
+		return "", name, true
+	}
+	if i := strings.Index(name, "/pm-src"); i >= 0 {
+		rest = name[i+1:]
+		if rest == "pm-src" || strings.HasPrefix(rest, "pm-src/") {
+			return name[:i], rest, true
+		}
+	}
+	return "", name, false
+}
+
+// siteCandidates returns the names that the site-relative name (starting with
+// pm-src, pm-template or pm-static) may be found at, in order of precedence.
+func siteCandidates(sitePrefix, name string) []string {
+	shared := name
+	if name == "pm-src" || strings.HasPrefix(name, "pm-src/") {
+		shared = path.Join(sitePrefix, name)
+	}
+	return []string{path.Join("pm-site", sitePrefix, name), shared}
+}
+
+// openFirst opens the first of names that exists. It returns the names that
+// were looked at, the last of which is the name of the opened file.
+func openFirst(fsys fs.FS, names []string) (fs.File, []string, error) {
+	for i, name := range names {
+		file, err := fsys.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, names[:i+1], err
+		}
+		return file, names[:i+1], nil
+	}
+	return nil, names, &fs.PathError{Op: "open", Path: names[len(names)-1], Err: fs.ErrNotExist}
+}
+
+// siteReadDir reads the site-relative directory name, merging the entries of
+// the pm-site override directory over the shared one.
+func siteReadDir(fsys fs.FS, sitePrefix, name string) ([]fs.DirEntry, error) {
+	var entries []fs.DirEntry
+	var notExist error
+	found := false
+	seen := make(map[string]struct{})
+	for _, dir := range siteCandidates(sitePrefix, name) {
+		dirEntries, err := fs.ReadDir(fsys, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			notExist = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		for _, entry := range dirEntries {
+			if _, ok := seen[entry.Name()]; ok {
+				continue
+			}
+			seen[entry.Name()] = struct{}{}
+			entries = append(entries, entry)
+		}
+	}
+	if !found {
+		return nil, notExist
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// siteWalkDir is like fs.WalkDir over the site-relative directory root, with
+// pm-site overrides merged in. The names passed to fn are site-relative. If fn
+// returns fs.SkipDir for a directory its contents are skipped.
+func siteWalkDir(fsys fs.FS, sitePrefix, root string, fn func(name string, d fs.DirEntry) error) error {
+	entries, err := siteReadDir(fsys, sitePrefix, root)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(root, entry.Name())
+		err = fn(name, entry)
+		if errors.Is(err, fs.SkipDir) && entry.IsDir() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			err = siteWalkDir(fsys, sitePrefix, name, fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// staticCandidates returns the names that /pm-static/<name> may be served
+// from for a site. Files under pm-static/pm-template fall back to the theme
+// files in pm-template.
+func staticCandidates(sitePrefix, name string) []string {
+	name = path.Join("pm-static", strings.TrimPrefix(strings.TrimPrefix(name, "/"), "pm-static"))
+	names := siteCandidates(sitePrefix, name)
+	if strings.HasPrefix(name, "pm-static/pm-template/") {
+		names = append(names, siteCandidates(sitePrefix, strings.TrimPrefix(name, "pm-static/"))...)
+	}
+	return names
+}
+
+// siteFS is the view of fsys from a site. Names are relative to the site and
+// are resolved with siteCandidates, so pm-src/x opens the site's own page
+// while pm-template/x opens the site's theme file.
+type siteFS struct {
+	fsys       fs.FS
+	sitePrefix string
+}
+
+func (fsys siteFS) valid(op, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	for _, dir := range []string{"pm-src", "pm-template", "pm-static"} {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			return nil
+		}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys siteFS) Open(name string) (fs.File, error) {
+	if err := fsys.valid("open", name); err != nil {
+		return nil, err
+	}
+	file, _, err := openFirst(fsys.fsys, siteCandidates(fsys.sitePrefix, name))
+	return file, err
+}
+
+func (fsys siteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := fsys.valid("readdir", name); err != nil {
+		return nil, err
+	}
+	return siteReadDir(fsys.fsys, fsys.sitePrefix, name)
+}
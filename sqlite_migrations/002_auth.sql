@@ -0,0 +1,30 @@
+CREATE TABLE pm_user (
+    user_id UUID PRIMARY KEY NOT NULL
+    ,username TEXT NOT NULL
+    ,password_hash TEXT NOT NULL
+    ,created_at DATETIME NOT NULL
+
+    ,CONSTRAINT pm_user_username_key UNIQUE (username)
+);
+
+CREATE TABLE pm_site_user (
+    site_id UUID NOT NULL
+    ,user_id UUID NOT NULL
+    ,role TEXT NOT NULL -- 'owner' | 'editor'
+
+    ,CONSTRAINT pm_site_user_site_id_user_id_pkey PRIMARY KEY (site_id, user_id)
+    ,CONSTRAINT pm_site_user_site_id_fkey FOREIGN KEY (site_id) REFERENCES pm_site (site_id)
+    ,CONSTRAINT pm_site_user_user_id_fkey FOREIGN KEY (user_id) REFERENCES pm_user (user_id)
+);
+
+CREATE INDEX pm_site_user_user_id_idx ON pm_site_user (user_id);
+
+CREATE TABLE pm_session (
+    session_hash TEXT PRIMARY KEY NOT NULL
+    ,user_id UUID NOT NULL
+    ,expires_at DATETIME NOT NULL
+
+    ,CONSTRAINT pm_session_user_id_fkey FOREIGN KEY (user_id) REFERENCES pm_user (user_id)
+);
+
+CREATE INDEX pm_session_user_id_idx ON pm_session (user_id);
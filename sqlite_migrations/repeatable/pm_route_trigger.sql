@@ -24,6 +24,13 @@ BEGIN
     WHERE pm_route.route_id = NEW.route_id;
 END;
 
+DROP TRIGGER IF EXISTS pm_route_root_after_insert_trigger;
+CREATE TRIGGER pm_route_root_after_insert_trigger AFTER INSERT ON pm_route
+FOR EACH ROW WHEN NEW.parent_route_id IS NULL
+BEGIN
+    UPDATE pm_route SET path = NEW.basename WHERE route_id = NEW.route_id;
+END;
+
 DROP TRIGGER IF EXISTS pm_route_after_delete_trigger;
 CREATE TRIGGER pm_route_after_delete_trigger AFTER DELETE ON pm_route
 BEGIN
@@ -31,12 +38,12 @@ BEGIN
 END;
 
 DROP TRIGGER IF EXISTS pm_route_path_after_update_trigger;
-CREATE TRIGGER pm_route_path_after_update_trigger AFTER UPDATE ON pm_route
-FOR EACH ROW WHEN OLD.basename <> NEW.basename
+CREATE TRIGGER pm_route_path_after_update_trigger AFTER UPDATE OF basename ON pm_route
+FOR EACH ROW WHEN OLD.basename IS NOT NEW.basename
 BEGIN
     UPDATE pm_route
     SET path = (
-        SELECT group_concat(ancestors.basename, '/') || '/' || pm_route.basename AS path
+        SELECT COALESCE(group_concat(ancestors.basename, '/') || '/', '') || pm_route.basename AS path
         FROM (
             SELECT ancestor.basename
             FROM pm_route_closure JOIN pm_route AS ancestor ON ancestor.route_id = pm_route_closure.ancestor_route_id
@@ -44,7 +51,72 @@ BEGIN
             ORDER BY pm_route_closure.depth
         ) AS ancestors
     )
-    WHERE pm_route.route_id = NEW.route_id OR EXISTS (
-        SELECT 1 FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
+    WHERE pm_route.route_id = NEW.route_id OR pm_route.route_id IN (
+        SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
     );
 END;
+
+DROP TRIGGER IF EXISTS pm_route_parent_before_update_trigger;
+CREATE TRIGGER pm_route_parent_before_update_trigger BEFORE UPDATE OF parent_route_id ON pm_route
+FOR EACH ROW WHEN NEW.parent_route_id IS NOT NULL AND (
+    NEW.parent_route_id = NEW.route_id
+    OR NEW.parent_route_id IN (SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id)
+)
+BEGIN
+    SELECT RAISE(ABORT, 'cannot move a route under itself');
+END;
+
+-- Moving a route detaches its subtree from the old ancestors, attaches it to
+-- the new ones and then recomputes the depths and paths within the subtree.
+DROP TRIGGER IF EXISTS pm_route_parent_after_update_trigger;
+CREATE TRIGGER pm_route_parent_after_update_trigger AFTER UPDATE OF parent_route_id ON pm_route
+FOR EACH ROW WHEN OLD.parent_route_id IS NOT NEW.parent_route_id
+BEGIN
+    DELETE FROM pm_route_closure
+    WHERE route_id IN (
+        SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
+        UNION SELECT NEW.route_id
+    ) AND ancestor_route_id NOT IN (
+        SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
+        UNION SELECT NEW.route_id
+    );
+
+    INSERT INTO pm_route_closure (route_id, ancestor_route_id, depth)
+    SELECT subtree.route_id, ancestors.ancestor_route_id, ancestors.depth
+    FROM (
+        SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
+        UNION SELECT NEW.route_id
+    ) AS subtree
+    CROSS JOIN (
+        SELECT ancestor_route_id, depth FROM pm_route_closure WHERE route_id = NEW.parent_route_id
+        UNION ALL
+        SELECT NEW.parent_route_id, (SELECT COUNT(*) FROM pm_route_closure WHERE route_id = NEW.parent_route_id)+1
+    ) AS ancestors
+    WHERE NEW.parent_route_id IS NOT NULL;
+
+    UPDATE pm_route_closure
+    SET depth = (
+        SELECT COUNT(*) FROM pm_route_closure AS closure WHERE closure.route_id = pm_route_closure.ancestor_route_id
+    )+1
+    WHERE ancestor_route_id IN (
+        SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
+        UNION SELECT NEW.route_id
+    );
+
+    UPDATE pm_route
+    SET path = (
+        SELECT COALESCE(group_concat(ancestors.basename, '/') || '/', '') || pm_route.basename AS path
+        FROM (
+            SELECT ancestor.basename
+            FROM pm_route_closure JOIN pm_route AS ancestor ON ancestor.route_id = pm_route_closure.ancestor_route_id
+            WHERE pm_route_closure.route_id = pm_route.route_id
+            ORDER BY pm_route_closure.depth
+        ) AS ancestors
+    )
+    WHERE pm_route.route_id = NEW.route_id OR pm_route.route_id IN (
+        SELECT route_id FROM pm_route_closure WHERE ancestor_route_id = NEW.route_id
+    );
+END;
+
+-- Root routes used to be inserted without a path.
+UPDATE pm_route SET path = basename WHERE parent_route_id IS NULL AND path IS NULL;
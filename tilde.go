@@ -0,0 +1,440 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errQuotaExceeded  = errors.New("disk quota exceeded")
+	tildePrefixRegexp = regexp.MustCompile(`^~[a-z0-9][a-z0-9_-]*$`)
+)
+
+// CreateSite provisions the tilde site <domain>/<subdomain>/<tildePrefix>
+// owned by the user: its directory is created from the starter files in
+// pm-starter (e.g. pm-starter/pm-src/index.html becomes
+// ~alice/pm-src/index.html) and it is registered in pm_site. It returns the
+// new site's ID.
+//
+// Tilde sites share an origin, so in online mode every page they serve is
+// sandboxed (see tildeSandbox): their scripts run in an opaque origin and
+// cannot read or use the sessions of other sites' editors. The site at the
+// root of the domain is not sandboxed and must only be edited by trusted
+// users.
+func (pm *Pagemanager) CreateSite(ctx context.Context, domain, subdomain, tildePrefix, userID string) (string, error) {
+	if pm.db == nil {
+		return "", fmt.Errorf("CreateSite: no DB configured")
+	}
+	if pm.wfs == nil {
+		return "", errNotWriteable
+	}
+	if !tildePrefixRegexp.MatchString(tildePrefix) {
+		return "", fmt.Errorf("invalid tilde prefix %q", tildePrefix)
+	}
+	sitePrefix := path.Join(domain, subdomain, tildePrefix)
+	for _, name := range siteCandidates(sitePrefix, "pm-src") {
+		_, err := fs.Stat(pm.fs, name)
+		if err == nil {
+			return "", fmt.Errorf("site %q: %w", sitePrefix, fs.ErrExist)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+	siteID, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	tx, err := pm.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "INSERT INTO pm_site (site_id, domain, subdomain, tilde_prefix) VALUES (?, NULLIF(?, ''), NULLIF(?, ''), ?)",
+		siteID, domain, subdomain, tildePrefix,
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO pm_site_user (site_id, user_id, role) VALUES (?, ?, 'owner')", siteID, userID)
+	if err != nil {
+		return "", err
+	}
+	// The site is registered before its files are written so that they
+	// count towards the quota of its owner.
+	err = tx.Commit()
+	if err != nil {
+		return "", err
+	}
+	err = pm.copyStarter(sitePrefix)
+	if err != nil {
+		_ = pm.wfs.RemoveAll(sitePrefix)
+		_ = pm.wfs.RemoveAll(path.Join("pm-site", sitePrefix))
+		_, _ = pm.db.ExecContext(ctx, "DELETE FROM pm_site_user WHERE site_id = ?", siteID)
+		_, _ = pm.db.ExecContext(ctx, "DELETE FROM pm_site WHERE site_id = ?", siteID)
+		return "", err
+	}
+	return siteID, nil
+}
+
+// copyStarter copies the pm-starter directory into the site. A site always
+// gets a pm-src directory even if there is no pm-starter. pm-src goes to
+// <prefix>/pm-src and the rest (e.g. pm-template) to pm-site/<prefix>, which
+// is where siteCandidates looks for a site's own theme.
+func (pm *Pagemanager) copyStarter(sitePrefix string) error {
+	err := pm.wfs.MkdirAll(path.Join(sitePrefix, "pm-src"), 0755)
+	if err != nil {
+		return err
+	}
+	err = fs.WalkDir(pm.fs, "pm-starter", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		b, err := fs.ReadFile(pm.fs, name)
+		if err != nil {
+			return err
+		}
+		name = strings.TrimPrefix(name, "pm-starter/")
+		if strings.HasPrefix(name, "pm-src/") {
+			return pm.writeFile(path.Join(sitePrefix, name), b)
+		}
+		return pm.writeFile(path.Join("pm-site", sitePrefix, name), b)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// quotaFS limits the total size of the files of the tilde sites of each
+// user, counting both <prefix>/ and pm-site/<prefix>/ of every site the user
+// owns. A site with several owners counts towards the owner with the lowest
+// user ID. Without a DB, or for a site without an owner, the limit applies
+// to the site by itself. Files outside tilde sites and the revisions in
+// <prefix>/pm-revision, which users cannot prune, are not limited.
+//
+// The usage of a user is computed the first time one of their sites is
+// written to and then kept up to date with the size of each write, so
+// changes made other than through the quotaFS, including changes of
+// ownership, are only seen after a restart.
+type quotaFS struct {
+	WriteableFS
+	db     *sql.DB
+	limit  int64
+	mu     sync.Mutex
+	sites  map[string]*usage // Keyed by site prefix.
+	owners map[string]*usage // Keyed by user ID.
+}
+
+type usage struct {
+	mu     sync.Mutex // Held while one of the sites is being written to.
+	userID string     // Empty if the usage is of a single site.
+	known  bool
+	usage  int64
+}
+
+// site returns the usage that writes to the site count towards, locked.
+func (fsys *quotaFS) site(sitePrefix string) (*usage, error) {
+	fsys.mu.Lock()
+	u := fsys.sites[sitePrefix]
+	fsys.mu.Unlock()
+	if u == nil {
+		userID, err := fsys.owner(sitePrefix)
+		if err != nil {
+			return nil, err
+		}
+		fsys.mu.Lock()
+		if fsys.sites == nil {
+			fsys.sites = make(map[string]*usage)
+			fsys.owners = make(map[string]*usage)
+		}
+		u = fsys.sites[sitePrefix]
+		if u == nil && userID != "" {
+			u = fsys.owners[userID]
+			if u == nil {
+				u = &usage{userID: userID}
+				fsys.owners[userID] = u
+			}
+		}
+		if u == nil {
+			u = &usage{}
+		}
+		fsys.sites[sitePrefix] = u
+		fsys.mu.Unlock()
+	}
+	u.mu.Lock()
+	if !u.known {
+		sitePrefixes := []string{sitePrefix}
+		if u.userID != "" {
+			var err error
+			sitePrefixes, err = fsys.ownedSites(u.userID)
+			if err != nil {
+				u.mu.Unlock()
+				return nil, err
+			}
+		}
+		var total int64
+		for _, sitePrefix := range sitePrefixes {
+			for _, root := range []string{sitePrefix, path.Join("pm-site", sitePrefix)} {
+				size, err := fsys.size(sitePrefix, root)
+				if err != nil {
+					u.mu.Unlock()
+					return nil, err
+				}
+				total += size
+			}
+		}
+		u.usage = total
+		u.known = true
+	}
+	return u, nil
+}
+
+// owner returns the ID of the user that the tilde site counts towards, or
+// "" if there is none.
+func (fsys *quotaFS) owner(sitePrefix string) (string, error) {
+	if fsys.db == nil {
+		return "", nil
+	}
+	var domain, subdomain string
+	segments := strings.Split(sitePrefix, "/")
+	tildePrefix := segments[len(segments)-1]
+	if len(segments) > 1 {
+		domain = segments[0]
+	}
+	if len(segments) > 2 {
+		subdomain = segments[1]
+	}
+	var userID sql.NullString
+	err := fsys.db.QueryRowContext(context.Background(), "SELECT MIN(pm_site_user.user_id)"+
+		" FROM pm_site"+
+		" JOIN pm_site_user ON pm_site_user.site_id = pm_site.site_id AND pm_site_user.role = 'owner'"+
+		" WHERE COALESCE(pm_site.domain, '') = ? AND COALESCE(pm_site.subdomain, '') = ? AND pm_site.tilde_prefix = ?",
+		domain, subdomain, tildePrefix,
+	).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+	return userID.String, nil
+}
+
+// ownedSites returns the prefixes of the tilde sites that count towards the
+// user.
+func (fsys *quotaFS) ownedSites(userID string) ([]string, error) {
+	rows, err := fsys.db.QueryContext(context.Background(), "SELECT COALESCE(pm_site.domain, ''), COALESCE(pm_site.subdomain, ''), pm_site.tilde_prefix"+
+		" FROM pm_site"+
+		" JOIN (SELECT site_id, MIN(user_id) AS user_id FROM pm_site_user WHERE role = 'owner' GROUP BY site_id) AS owner ON owner.site_id = pm_site.site_id"+
+		" WHERE owner.user_id = ? AND COALESCE(pm_site.tilde_prefix, '') <> ''",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sitePrefixes []string
+	for rows.Next() {
+		var domain, subdomain, tildePrefix string
+		err = rows.Scan(&domain, &subdomain, &tildePrefix)
+		if err != nil {
+			return nil, err
+		}
+		sitePrefixes = append(sitePrefixes, path.Join(domain, subdomain, tildePrefix))
+	}
+	return sitePrefixes, rows.Err()
+}
+
+func (fsys *quotaFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	sitePrefix := tildeSitePrefix(name)
+	if sitePrefix == "" || isRevisionName(sitePrefix, name) {
+		return fsys.WriteableFS.WriteFile(name, data, perm)
+	}
+	u, err := fsys.site(sitePrefix)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	var oldSize int64
+	if fileinfo, err := fs.Stat(fsys.WriteableFS, name); err == nil {
+		oldSize = fileinfo.Size()
+	}
+	delta := int64(len(data)) - oldSize
+	if delta > 0 && u.usage+delta > fsys.limit {
+		return &fs.PathError{Op: "writefile", Path: name, Err: errQuotaExceeded}
+	}
+	err = fsys.WriteableFS.WriteFile(name, data, perm)
+	if err != nil {
+		u.known = false
+		return err
+	}
+	u.usage += delta
+	return nil
+}
+
+// MkdirAll refuses to create directories in a site that is out of space.
+func (fsys *quotaFS) MkdirAll(name string, perm fs.FileMode) error {
+	sitePrefix := tildeSitePrefix(name + "/")
+	if sitePrefix == "" || isRevisionName(sitePrefix, name) {
+		return fsys.WriteableFS.MkdirAll(name, perm)
+	}
+	u, err := fsys.site(sitePrefix)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	if u.usage >= fsys.limit {
+		if _, err := fs.Stat(fsys.WriteableFS, name); err != nil {
+			return &fs.PathError{Op: "mkdirall", Path: name, Err: errQuotaExceeded}
+		}
+	}
+	return fsys.WriteableFS.MkdirAll(name, perm)
+}
+
+func (fsys *quotaFS) RemoveAll(name string) error {
+	sitePrefix := tildeSitePrefix(name + "/")
+	if sitePrefix == "" || isRevisionName(sitePrefix, name) {
+		return fsys.WriteableFS.RemoveAll(name)
+	}
+	u, err := fsys.site(sitePrefix)
+	if err != nil {
+		return err
+	}
+	defer u.mu.Unlock()
+	size, err := fsys.size(sitePrefix, name)
+	if err != nil {
+		return err
+	}
+	err = fsys.WriteableFS.RemoveAll(name)
+	if err != nil {
+		u.known = false
+		return err
+	}
+	u.usage -= size
+	return nil
+}
+
+// size returns the total size of the files of the site under root, which
+// may also be a file. It is 0 if root does not exist.
+func (fsys *quotaFS) size(sitePrefix, root string) (int64, error) {
+	var size int64
+	err := fs.WalkDir(fsys.WriteableFS, root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if isRevisionName(sitePrefix, name) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		fileinfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fileinfo.Size()
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	return size, nil
+}
+
+// isRevisionName reports whether name is in the revisions of the site.
+func isRevisionName(sitePrefix, name string) bool {
+	root := path.Join(sitePrefix, revisionDir)
+	return name == root || strings.HasPrefix(name, root+"/")
+}
+
+// tildeSitePrefix returns the prefix of the tilde site that name belongs to
+// (e.g. example.com/~alice for pm-site/example.com/~alice/pm-src/index.html),
+// or "" if it does not belong to one.
+func tildeSitePrefix(name string) string {
+	segments := strings.Split(strings.TrimPrefix(name, "pm-site/"), "/")
+	for i, segment := range segments[:len(segments)-1] {
+		if i > 2 || strings.HasPrefix(segment, "pm-") {
+			break
+		}
+		if strings.HasPrefix(segment, "~") {
+			return path.Join(segments[:i+1]...)
+		}
+	}
+	return ""
+}
+
+// SiteEntry is an entry of Funcs.Sites.
+type SiteEntry struct {
+	url.URL
+	TildePrefix string
+	Owner       string // Username of the site's owner, empty without a DB.
+}
+
+// Sites lists the tilde sites on the current domain and subdomain, ordered by
+// tilde prefix. Sites are read from pm_site if there is a DB, otherwise from
+// the directories in FS.
+//
+//	{{ range query "github.com/pagemanager/pagemanager.Funcs.Sites" .PageContext }}
+//	<a href="{{ .Path }}">{{ .TildePrefix }}</a>
+//	{{ end }}
+func (f *Funcs) Sites(pc *PageContext, args ...string) (any, error) {
+	ctx := pc.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var entries []SiteEntry
+	newEntry := func(tildePrefix, owner string) SiteEntry {
+		entry := SiteEntry{URL: *pc.URL, TildePrefix: tildePrefix, Owner: owner}
+		entry.URL.Path = "/" + tildePrefix + "/"
+		entry.URL.RawQuery = ""
+		return entry
+	}
+	if f.db != nil {
+		rows, err := f.db.QueryContext(ctx, "SELECT pm_site.tilde_prefix, COALESCE(pm_user.username, '')"+
+			" FROM pm_site"+
+			" LEFT JOIN pm_site_user ON pm_site_user.site_id = pm_site.site_id AND pm_site_user.role = 'owner'"+
+			" LEFT JOIN pm_user ON pm_user.user_id = pm_site_user.user_id"+
+			" WHERE COALESCE(pm_site.domain, '') = ? AND COALESCE(pm_site.subdomain, '') = ? AND COALESCE(pm_site.tilde_prefix, '') <> ''"+
+			" ORDER BY pm_site.tilde_prefix, pm_user.username",
+			pc.Domain, pc.Subdomain,
+		)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var tildePrefix, owner string
+			err = rows.Scan(&tildePrefix, &owner)
+			if err != nil {
+				return nil, err
+			}
+			// A site with several owners is listed once.
+			if n := len(entries); n > 0 && entries[n-1].TildePrefix == tildePrefix {
+				continue
+			}
+			entries = append(entries, newEntry(tildePrefix, owner))
+		}
+		return entries, rows.Err()
+	}
+	sites, err := sites(f.fs)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sites {
+		if s.domain == pc.Domain && s.subdomain == pc.Subdomain && s.tildePrefix != "" {
+			entries = append(entries, newEntry(s.tildePrefix, ""))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TildePrefix < entries[j].TildePrefix })
+	return entries, nil
+}